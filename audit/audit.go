@@ -0,0 +1,223 @@
+// Package audit persists scheduled and sent new year announcements as JSON lines
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Events
+const (
+	Scheduled = "scheduled"
+	Sent      = "sent"
+	// The server echoed the announcement back (IRCv3 echo-message)
+	Delivered = "delivered"
+)
+
+// Record is a single audit log entry
+type Record struct {
+	Event   string  `json:"event"`
+	Server  string  `json:"server"`
+	Nick    string  `json:"nick"`
+	Channel string  `json:"channel"`
+	Offset  float64 `json:"offset"`
+	// Target year
+	Target int `json:"target"`
+	// Midnight in the zone
+	Scheduled time.Time `json:"scheduled"`
+	// When the announcement was sent
+	Sent time.Time `json:"sent,omitempty"`
+	// Server time of the echoed announcement
+	Delivered time.Time `json:"delivered,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Log is an append only JSON lines audit log
+type Log struct {
+	path string
+	file *os.File
+	sync.Mutex
+}
+
+// Logs are shared between the bots
+var logs = struct {
+	files map[string]*Log
+	sync.Mutex
+}{
+	files: make(map[string]*Log),
+}
+
+// Open opens the audit log for appending
+func Open(path string) (*Log, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	logs.Lock()
+	defer logs.Unlock()
+	if l, ok := logs.files[abs]; ok {
+		return l, nil
+	}
+	file, err := os.OpenFile(abs, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{path: abs, file: file}
+	logs.files[abs] = l
+	return l, nil
+}
+
+// Write appends a record to the log
+func (l *Log) Write(r Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	l.Lock()
+	defer l.Unlock()
+	_, err = l.file.Write(append(data, '\n'))
+	return err
+}
+
+// Read reads all records from r
+func Read(r io.Reader) ([]Record, error) {
+	var records []Record
+	scan := bufio.NewScanner(r)
+	scan.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scan.Scan() {
+		line++
+		if len(scan.Bytes()) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(scan.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		records = append(records, rec)
+	}
+	return records, scan.Err()
+}
+
+// Summary of the announcements in a channel
+type Summary struct {
+	Server    string
+	Channel   string
+	Scheduled int
+	Sent      int
+	Errors    int
+	// Announcements confirmed by the server
+	Delivered int
+	// Zones that were scheduled but never sent or failed
+	Missed []float64
+	// Mean and max lateness of the sent announcements
+	MeanLateness time.Duration
+	MaxLateness  time.Duration
+	// Zone of the latest announcement
+	MaxLatenessOffset float64
+}
+
+// Summarize summarizes the records per channel for the target year
+func Summarize(records []Record, target int) []Summary {
+	type key struct {
+		server, channel string
+	}
+	type zone struct {
+		scheduled, sent, failed, delivered bool
+	}
+	type channel struct {
+		Summary
+		zones map[float64]*zone
+		total time.Duration
+	}
+	channels := make(map[key]*channel)
+	for _, r := range records {
+		if r.Target != target {
+			continue
+		}
+		k := key{r.Server, r.Channel}
+		c, ok := channels[k]
+		if !ok {
+			c = &channel{
+				Summary: Summary{Server: r.Server, Channel: r.Channel},
+				zones:   make(map[float64]*zone),
+			}
+			channels[k] = c
+		}
+		z, ok := c.zones[r.Offset]
+		if !ok {
+			z = &zone{}
+			c.zones[r.Offset] = z
+		}
+		switch r.Event {
+		case Scheduled:
+			if !z.scheduled {
+				c.Scheduled++
+			}
+			z.scheduled = true
+		case Sent:
+			if r.Error != "" {
+				c.Errors++
+				z.failed = true
+				continue
+			}
+			if z.sent {
+				continue
+			}
+			z.sent = true
+			c.Sent++
+			late := r.Sent.Sub(r.Scheduled)
+			c.total += late
+			if c.Sent == 1 || late > c.MaxLateness {
+				c.MaxLateness = late
+				c.MaxLatenessOffset = r.Offset
+			}
+		case Delivered:
+			if !z.delivered {
+				c.Delivered++
+			}
+			z.delivered = true
+		}
+	}
+	var res []Summary
+	for _, c := range channels {
+		for offset, z := range c.zones {
+			if !z.sent {
+				c.Missed = append(c.Missed, offset)
+			}
+		}
+		sort.Sort(sort.Reverse(sort.Float64Slice(c.Missed)))
+		if c.Sent > 0 {
+			c.MeanLateness = c.total / time.Duration(c.Sent)
+		}
+		res = append(res, c.Summary)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Server != res[j].Server {
+			return res[i].Server < res[j].Server
+		}
+		return res[i].Channel < res[j].Channel
+	})
+	return res
+}
+
+// OffsetName formats a zone offset as UTC+5:45
+func OffsetName(offset float64) string {
+	sign := "+"
+	if offset < 0 {
+		sign = "-"
+	}
+	minutes := int(math.Round(math.Abs(offset) * 60))
+	if minutes%60 == 0 {
+		return fmt.Sprintf("UTC%s%d", sign, minutes/60)
+	}
+	return fmt.Sprintf("UTC%s%d:%02d", sign, minutes/60, minutes%60)
+}
@@ -0,0 +1,121 @@
+package audit
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLogRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	midnight := time.Date(2024, 12, 31, 18, 15, 0, 0, time.UTC)
+	in := []Record{
+		{Event: Scheduled, Channel: "#test", Offset: 5.75, Target: 2025, Scheduled: midnight},
+		{Event: Sent, Channel: "#test", Offset: 5.75, Target: 2025, Scheduled: midnight,
+			Sent: midnight.Add(time.Second)},
+	}
+	for _, r := range in {
+		if err := l.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if same, _ := Open(path); same != l {
+		t.Error("audit log not shared")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := Read(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("expected %+v; got %+v", in, out)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	midnight := func(offset float64) time.Time {
+		return time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).
+			Add(-time.Duration(offset * float64(time.Hour)))
+	}
+	rec := func(event, ch string, offset float64, late time.Duration, err string) Record {
+		r := Record{
+			Event:     event,
+			Server:    "irc.example.com:6697",
+			Channel:   ch,
+			Offset:    offset,
+			Target:    2025,
+			Scheduled: midnight(offset),
+			Error:     err,
+		}
+		if event == Sent {
+			r.Sent = r.Scheduled.Add(late)
+		}
+		if event == Delivered {
+			r.Delivered = r.Scheduled.Add(late)
+		}
+		return r
+	}
+	records := []Record{
+		rec(Scheduled, "#a", 14, 0, ""),
+		rec(Sent, "#a", 14, time.Second, ""),
+		rec(Scheduled, "#a", 5.75, 0, ""),
+		rec(Sent, "#a", 5.75, 3*time.Second, ""),
+		rec(Delivered, "#a", 5.75, 4*time.Second, ""),
+		rec(Delivered, "#a", 5.75, 4*time.Second, ""),
+		rec(Scheduled, "#a", 1, 0, ""),
+		rec(Scheduled, "#b", 5.75, 0, ""),
+		rec(Sent, "#b", 5.75, 0, "not connected"),
+		// other year
+		{Event: Scheduled, Channel: "#c", Offset: 1, Target: 2024},
+	}
+	got := Summarize(records, 2025)
+	expected := []Summary{
+		{
+			Server:            "irc.example.com:6697",
+			Channel:           "#a",
+			Scheduled:         3,
+			Sent:              2,
+			Delivered:         1,
+			Missed:            []float64{1},
+			MeanLateness:      2 * time.Second,
+			MaxLateness:       3 * time.Second,
+			MaxLatenessOffset: 5.75,
+		},
+		{
+			Server:    "irc.example.com:6697",
+			Channel:   "#b",
+			Scheduled: 1,
+			Errors:    1,
+			Missed:    []float64{5.75},
+		},
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected %+v; got %+v", expected, got)
+	}
+}
+
+func TestOffsetName(t *testing.T) {
+	tt := map[float64]string{
+		0:     "UTC+0",
+		14:    "UTC+14",
+		5.75:  "UTC+5:45",
+		-9.5:  "UTC-9:30",
+		-12:   "UTC-12",
+		12.75: "UTC+12:45",
+	}
+	for offset, name := range tt {
+		if got := OffsetName(offset); got != name {
+			t.Errorf("%v: expected %s; got %s", offset, name, got)
+		}
+	}
+}
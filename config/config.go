@@ -0,0 +1,202 @@
+// Package config loads the bots' configuration from yaml, json or toml files
+// and the NYB_ environment variables
+package config
+
+//go:generate go run ../utils/schemagen -o ../settings.schema.json
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/ugjka/newyearsbot/nyb"
+	"gopkg.in/yaml.v3"
+)
+
+// Defaults of the optional fields
+const (
+	DefaultNominatim = "https://nominatim.openstreetmap.org"
+	DefaultServer    = "irc.libera.chat:6697"
+	DefaultPrefix    = "!"
+)
+
+// Config is the configuration of the bots, the keys in the files are the
+// lowercased field names, e.g. nossl or auth.password
+type Config []Bot
+
+// Bot is the configuration of a bot
+type Bot struct {
+	// Name in the control socket, defaults to nick@server
+	Name string
+	// IRC nick, at most 16 characters
+	Nick string
+	// Channels to join, a channel key can follow a ":", e.g. #chan:key
+	Channels []string
+	// IRC server host:port (default: irc.libera.chat:6697)
+	Server string
+	// Servers to try when the server is unreachable
+	Fallbacks []string
+	// Disable SSL for irc
+	NoSSL bool
+	// Proxy for irc and geocoding: socks5://[user:pass@]host:port or http://[user:pass@]host:port
+	Proxy string
+	// IRC server password
+	Password string
+	// Command prefix, must be non-alphanumeric (default: !)
+	Prefix string
+	// Contact email for the nominatim usage policy
+	Email string
+	// Nominatim server (default: https://nominatim.openstreetmap.org)
+	Nominatim string
+	// Disable the flood kick protection
+	NoLimit bool
+	// Decorate irc messages
+	Colors bool
+	// Debug irc traffic
+	Debug bool
+	// Append announcements to this audit log file
+	Audit string
+	// Remember the announced zones in this file between restarts
+	State string
+	// Remember the users' locations in this file
+	Users    string
+	Auth     nyb.Auth
+	TLS      nyb.TLS
+	Log      nyb.LogConfig
+	Commands nyb.Commands
+}
+
+// ID is the bot's name, defaults to nick@server
+func (b Bot) ID() string {
+	if b.Name != "" {
+		return b.Name
+	}
+	return b.Nick + "@" + b.Server
+}
+
+// Load reads and checks the config file with the ${VAR} references,
+// the <field>_file secrets and the environment variables filled in.
+// The format is picked by the extension: .yaml, .yml, .json or .toml.
+// All the problems are reported at once as Errors, with their lines in yaml files
+func Load(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := parse(path, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := interpolate(doc); err != nil {
+		return nil, err
+	}
+	var c Config
+	if err := doc.Decode(&c); err != nil {
+		return nil, err
+	}
+	var raw []map[string]interface{}
+	if err := doc.Decode(&raw); err != nil {
+		return nil, err
+	}
+	for i := range c {
+		if err := secretFiles(reflect.ValueOf(&c[i]).Elem(), raw[i], ""); err != nil {
+			return nil, fmt.Errorf("bot %d: %v", i, err)
+		}
+	}
+	c, err = ApplyEnv(c)
+	if err != nil {
+		return nil, err
+	}
+	c.Defaults()
+	errs := strict(path, doc)
+	if err := c.Check(); err != nil {
+		invalid, ok := err.(Errors)
+		if !ok {
+			return nil, err
+		}
+		locate(path, doc, invalid)
+		errs = append(errs, invalid...)
+	}
+	if len(errs) > 0 {
+		sort.SliceStable(errs, func(i, j int) bool {
+			if errs[i].Entry != errs[j].Entry {
+				return errs[i].Entry < errs[j].Entry
+			}
+			return errs[i].Line < errs[j].Line
+		})
+		return nil, errs
+	}
+	return c, nil
+}
+
+// parse parses the file into a yaml document,
+// json and toml files have no line numbers
+func parse(path string, data []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		return &doc, nil
+	case ".json":
+		var raw []interface{}
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, err
+		}
+		return encode(raw)
+	case ".toml":
+		// The bots are an array of [[bot]] tables
+		var raw map[string]interface{}
+		if _, err := toml.Decode(string(data), &raw); err != nil {
+			return nil, err
+		}
+		for key := range raw {
+			if key != "bot" {
+				return nil, fmt.Errorf("unknown table: %s, the bots are [[bot]] tables", key)
+			}
+		}
+		return encode(raw["bot"])
+	default:
+		return nil, fmt.Errorf("unknown config format %q, use .yaml, .yml, .json or .toml", ext)
+	}
+}
+
+func encode(raw interface{}) (*yaml.Node, error) {
+	var node yaml.Node
+	if raw != nil {
+		if err := node.Encode(raw); err != nil {
+			return nil, err
+		}
+	}
+	forget(&node)
+	return &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{&node}}, nil
+}
+
+// forget drops the positions of the re-encoded nodes, they aren't lines in the file
+func forget(node *yaml.Node) {
+	node.Line, node.Column = 0, 0
+	for _, n := range node.Content {
+		forget(n)
+	}
+}
+
+// Defaults fills in the optional fields
+func (c Config) Defaults() {
+	for i := range c {
+		if c[i].Nominatim == "" {
+			c[i].Nominatim = DefaultNominatim
+		}
+		if c[i].Server == "" {
+			c[i].Server = DefaultServer
+		}
+		if c[i].Prefix == "" {
+			c[i].Prefix = DefaultPrefix
+		}
+	}
+}
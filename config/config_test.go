@@ -0,0 +1,247 @@
+package config_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ugjka/newyearsbot/config"
+)
+
+const (
+	yamlConfig = `
+- name: party
+  nick: hnyparty
+  channels: ["#test", "#test2:key"]
+  fallbacks: [irc.eu.libera.chat:6697]
+  email: test@example.com
+  auth:
+    mode: sasl
+    password_file: %s
+  log:
+    maxsize: 10
+    levels: {irc: debug}
+`
+	jsonConfig = `[
+	{
+		"name": "party",
+		"nick": "hnyparty",
+		"channels": ["#test", "#test2:key"],
+		"fallbacks": ["irc.eu.libera.chat:6697"],
+		"email": "test@example.com",
+		"auth": {"mode": "sasl", "password_file": "%s"},
+		"log": {"maxsize": 10, "levels": {"irc": "debug"}}
+	}
+]`
+	tomlConfig = `
+[[bot]]
+name = "party"
+nick = "hnyparty"
+channels = ["#test", "#test2:key"]
+fallbacks = ["irc.eu.libera.chat:6697"]
+email = "test@example.com"
+
+[bot.auth]
+mode = "sasl"
+password_file = "%s"
+
+[bot.log]
+maxsize = 10
+levels = {irc = "debug"}
+`
+)
+
+// write writes the config file, %s is the password file
+func write(t *testing.T, name, content string) string {
+	t.Helper()
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "password")
+	if err := os.WriteFile(secret, []byte("hunter2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, name)
+	content = strings.ReplaceAll(content, "%s", secret)
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadFormats(t *testing.T) {
+	var want config.Config
+	for _, tc := range []struct{ name, content string }{
+		{"settings.yaml", yamlConfig},
+		{"settings.json", jsonConfig},
+		{"settings.toml", tomlConfig},
+	} {
+		c, err := config.Load(write(t, tc.name, tc.content))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if len(c) != 1 || c[0].Auth.Password != "hunter2" || c[0].Server != config.DefaultServer ||
+			c[0].Log.Levels["irc"] != "debug" || c[0].ID() != "party" {
+			t.Errorf("%s: unexpected config: %+v", tc.name, c)
+		}
+		if want == nil {
+			want = c
+		} else if !reflect.DeepEqual(c, want) {
+			t.Errorf("%s: expected %+v; got %+v", tc.name, want, c)
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, tc := range []struct{ name, content, want string }{
+		{"bad.yaml", "- nick: hnyparty\n  channels: [\"#test\", \"bad chan\"]\n  nosl: true\n",
+			"error: %s:1:3: bot 0: email: no email provided\n" +
+				"error: %s:2:23: bot 0: channels[1]: invalid channel name: bad chan\n" +
+				"error: %s:3:3: bot 0: nosl: unknown field"},
+		{"bad.json", `[{"nick": "hnyparty", "channels": ["#test"], "email": "test@example.com", "nosl": true}]`,
+			"error: bot 0: nosl: unknown field"},
+		{"bad.toml", "[[bot]]\nnick = \"hnyparty\"\nchannels = [\"#test\"]\n",
+			"error: bot 0: email: no email provided"},
+		{"commands.yaml", "- nick: hnyparty\n  channels: [\"#test\"]\n  email: test@example.com\n" +
+			"  commands:\n    aliases:\n      hny: [time]\n",
+			"error: %s:5:5: bot 0: commands: alias of hny already names a command: time"},
+		{"password.yaml", "- nick: hnyparty\n  channels: [\"#test\"]\n  email: test@example.com\n" +
+			"  password: serverpass\n  auth:\n    mode: sasl\n    password: secret\n",
+			"error: %s:4:13: bot 0: password: server password can't be used with sasl auth, set auth.password instead"},
+		{"log.yaml", "- nick: hnyparty\n  channels: [\"#test\"]\n  email: test@example.com\n" +
+			"  log: {file: nyb.log, maxsize: 10}\n" +
+			"- nick: hnyparty2\n  channels: [\"#test\"]\n  email: test@example.com\n" +
+			"  log: {file: nyb.log, maxsize: 10, maxbackups: 3}\n",
+			"error: %s:8:8: bot 1: log: log file shared with different rotation settings: nyb.log"},
+		{"disabled.yaml", "- nick: hnyparty\n  channels: [\"#test:key\"]\n  email: test@example.com\n" +
+			"  commands:\n    disabled:\n      \"#TEST\": [schedule]\n      \"#typo\": [hny]\n",
+			"error: %s:5:5: bot 0: commands: commands disabled in a channel the bot doesn't join: #typo"},
+	} {
+		file := write(t, tc.name, tc.content)
+		_, err := config.Load(file)
+		if _, ok := err.(config.Errors); !ok {
+			t.Fatalf("%s: expected config errors; got %v", tc.name, err)
+		}
+		if want := strings.ReplaceAll(tc.want, "%s", file); err.Error() != want {
+			t.Errorf("%s: expected\n%s\ngot\n%s", tc.name, want, err)
+		}
+	}
+	for _, tc := range []struct{ name, content string }{
+		{"settings.ini", "nick = hnyparty"},
+		{"empty.toml", ""},
+		{"other.toml", "[[bots]]\nnick = \"hnyparty\"\n"},
+		{"object.json", `{"nick": "hnyparty"}`},
+	} {
+		if _, err := config.Load(write(t, tc.name, tc.content)); err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+}
+
+func TestEnv(t *testing.T) {
+	t.Setenv("NYB_0_NICK", "envparty")
+	t.Setenv("NYB_1_NICK", "second")
+	t.Setenv("NYB_1_CHANNELS", "#a, #b")
+	t.Setenv("NYB_1_EMAIL", "test@example.com")
+	t.Setenv("NYB_1_LOG_LEVELS", "irc=debug,geocoder=warn")
+	t.Setenv("NYB_1_COMMANDS_ALIASES", "hny=ny,newyear,countdown=cd")
+	t.Setenv("NYB_1_COMMANDS_DISABLED", "#a=schedule, countdown")
+	c, err := config.Load(write(t, "settings.toml", tomlConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c) != 2 || c[0].Nick != "envparty" || c[1].ID() != "second@"+config.DefaultServer ||
+		!reflect.DeepEqual(c[1].Channels, []string{"#a", "#b"}) || c[1].Log.Levels["geocoder"] != "warn" {
+		t.Errorf("unexpected config: %+v", c)
+	}
+	aliases := map[string][]string{"hny": {"ny", "newyear"}, "countdown": {"cd"}}
+	disabled := map[string][]string{"#a": {"schedule", "countdown"}}
+	if !reflect.DeepEqual(c[1].Commands.Aliases, aliases) || !reflect.DeepEqual(c[1].Commands.Disabled, disabled) {
+		t.Errorf("unexpected commands: %+v", c[1].Commands)
+	}
+
+	t.Setenv("NYB_1_COMMANDS_ALIASES", "ny")
+	if _, err := config.Load(write(t, "settings.toml", tomlConfig)); err == nil ||
+		err.Error() != "NYB_1_COMMANDS_ALIASES: expected key=value: ny" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	t.Setenv("NYB_1_COMMANDS_ALIASES", "")
+
+	t.Setenv("NYB_0_NICKNAME", "typo")
+	if _, err := config.Load(write(t, "settings.toml", tomlConfig)); err == nil ||
+		err.Error() != "unknown environment variables: NYB_0_NICKNAME" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	const content = `
+# ${NOTSET} in a comment is left alone
+- nick: ${NICK}
+  channels: ["${CHANNEL}"]
+  email: test@example.com
+  name: $${literal}
+  auth:
+    mode: sasl
+    password: ${PASS}
+  log:
+    maxsize: ${SIZE}
+`
+	t.Setenv("NICK", "envparty")
+	t.Setenv("CHANNEL", "#test")
+	t.Setenv("SIZE", "10")
+	for _, pass := range []string{"a #b", "x: y", "[x", `"quoted" and 'single'`, "{a, b}", "null"} {
+		t.Setenv("PASS", pass)
+		c, err := config.Load(write(t, "settings.yaml", content))
+		if err != nil {
+			t.Fatalf("%q: %v", pass, err)
+		}
+		if len(c) != 1 || c[0].Auth.Password != pass || c[0].Nick != "envparty" || c[0].Channels[0] != "#test" ||
+			c[0].Name != "${literal}" || c[0].Log.MaxSize != 10 {
+			t.Errorf("%q: unexpected config: %+v", pass, c)
+		}
+	}
+
+	// The values of json and toml files are interpolated too
+	json := `[{"nick": "hnyparty", "channels": ["#test"], "email": "test@example.com", ` +
+		`"auth": {"mode": "sasl", "password": "${PASS}"}}]`
+	toml := "[[bot]]\nnick = \"hnyparty\"\nchannels = [\"#test\"]\nemail = \"test@example.com\"\n" +
+		"[bot.auth]\nmode = \"sasl\"\npassword = \"${PASS}\"\n"
+	t.Setenv("PASS", `a #b", "c`)
+	for _, tc := range []struct{ name, content string }{{"settings.json", json}, {"settings.toml", toml}} {
+		c, err := config.Load(write(t, tc.name, tc.content))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if c[0].Auth.Password != `a #b", "c` {
+			t.Errorf("%s: unexpected password: %q", tc.name, c[0].Auth.Password)
+		}
+	}
+
+	if _, err := config.Load(write(t, "settings.yaml", "- nick: ${NOTSET}\n")); err == nil ||
+		err.Error() != "undefined environment variable: NOTSET" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	docs, err := config.Docs(".", "../nyb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if docs["Bot.Nick"] == "" || docs["Auth.Mode"] == "" {
+		t.Errorf("missing field docs: %v", docs)
+	}
+	schema, err := config.Schema(docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := os.ReadFile("../settings.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(schema, saved) {
+		t.Error("settings.schema.json is out of date, run go generate ./config")
+	}
+}
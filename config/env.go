@@ -0,0 +1,263 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Environment variables of the bots are NYB_<index>_<FIELD>,
+// nested fields are joined with "_", e.g. NYB_0_AUTH_PASSWORD
+const envPrefix = "NYB_"
+
+var (
+	envVarReg   = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+	envIndexReg = regexp.MustCompile(`^` + envPrefix + `(\d+)_`)
+)
+
+// interpolate replaces ${VAR} in the values of the config file with the environment variable,
+// $${ is a literal ${. The document is parsed first, so the values can't change its syntax
+// and the references in the comments and the keys are left alone
+func interpolate(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if !strings.Contains(node.Value, "${") {
+			return nil
+		}
+		var err error
+		node.Value = envVarReg.ReplaceAllStringFunc(node.Value, func(m string) string {
+			if m == "$${" {
+				return "${"
+			}
+			name := envVarReg.FindStringSubmatch(m)[1]
+			val, ok := os.LookupEnv(name)
+			if !ok && err == nil {
+				err = fmt.Errorf("undefined environment variable: %s", name)
+			}
+			return val
+		})
+		if err != nil {
+			return err
+		}
+		// An unquoted reference can fill in a number or a boolean, never a null
+		if node.Style == 0 {
+			node.Tag = ""
+			if node.ShortTag() == "!!null" {
+				node.Tag = "!!str"
+			}
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := interpolate(node.Content[i]); err != nil {
+				return err
+			}
+		}
+	default:
+		for _, n := range node.Content {
+			if err := interpolate(n); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// yamlKey is the key of the struct field in the config files
+func yamlKey(f reflect.StructField) string {
+	if tag := strings.Split(f.Tag.Get("yaml"), ",")[0]; tag != "" {
+		return tag
+	}
+	return strings.ToLower(f.Name)
+}
+
+// secretFiles fills in the string fields from their <field>_file keys in the config file,
+// e.g. password_file: /run/secrets/irc
+func secretFiles(v reflect.Value, raw map[string]interface{}, path string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := yamlKey(t.Field(i))
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if nested, ok := raw[key].(map[string]interface{}); ok {
+				if err := secretFiles(field, nested, path+key+"."); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		file, ok := raw[key+"_file"]
+		if !ok {
+			continue
+		}
+		name, isString := file.(string)
+		if field.Kind() != reflect.String || !isString {
+			return fmt.Errorf("%s%s_file: must be a file name of a text field", path, key)
+		}
+		secret, err := readSecret(name)
+		if err != nil {
+			return fmt.Errorf("%s%s_file: %v", path, key, err)
+		}
+		field.SetString(secret)
+	}
+	return nil
+}
+
+// readSecret reads a secret file, the trailing newline is dropped
+func readSecret(name string) (string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// ApplyEnv sets the config fields from the NYB_ environment variables,
+// adding entries for indexes past the end of the config.
+// NYB_<index>_<FIELD>_FILE reads the value from a file
+func ApplyEnv(c Config) (Config, error) {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(k, envPrefix) {
+			continue
+		}
+		env[k] = v
+		if m := envIndexReg.FindStringSubmatch(k); m != nil {
+			i, err := strconv.Atoi(m[1])
+			if err != nil || i > 100 {
+				return nil, fmt.Errorf("%s: invalid bot index", k)
+			}
+			for len(c) <= i {
+				c = append(c, Bot{})
+			}
+		}
+	}
+	used := make(map[string]bool)
+	for i := range c {
+		prefix := fmt.Sprintf("%s%d_", envPrefix, i)
+		if err := envFields(reflect.ValueOf(&c[i]).Elem(), env, prefix, used); err != nil {
+			return nil, err
+		}
+	}
+	var unknown []string
+	for k := range env {
+		if envIndexReg.MatchString(k) && !used[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown environment variables: %s", strings.Join(unknown, ", "))
+	}
+	return c, nil
+}
+
+func envFields(v reflect.Value, env map[string]string, prefix string, used map[string]bool) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := prefix + strings.ToUpper(yamlKey(t.Field(i)))
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := envFields(field, env, name+"_", used); err != nil {
+				return err
+			}
+			continue
+		}
+		val, ok := env[name]
+		if file, isFile := env[name+"_FILE"]; isFile {
+			used[name+"_FILE"] = true
+			if ok {
+				return fmt.Errorf("%s and %s_FILE are both set", name, name)
+			}
+			secret, err := readSecret(file)
+			if err != nil {
+				return fmt.Errorf("%s_FILE: %v", name, err)
+			}
+			val, ok = secret, true
+		}
+		if !ok {
+			continue
+		}
+		used[name] = true
+		if err := setField(field, val); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// setField parses the value into the field,
+// lists are comma separated and maps are comma separated key=value pairs,
+// the lists in a map go on until the next key, e.g. hny=ny,newyear,time=t
+func setField(field reflect.Value, val string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(val)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("invalid boolean: %s", val)
+		}
+		field.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("invalid number: %s", val)
+		}
+		field.SetInt(int64(n))
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported field type %s", field.Type())
+		}
+		field.Set(reflect.ValueOf(splitList(val)))
+	case reflect.Map:
+		t := field.Type()
+		list := t.Elem().Kind() == reflect.Slice && t.Elem().Elem().Kind() == reflect.String
+		if t.Key().Kind() != reflect.String || (t.Elem().Kind() != reflect.String && !list) {
+			return fmt.Errorf("unsupported field type %s", t)
+		}
+		m := reflect.MakeMap(t)
+		var key reflect.Value
+		for _, kv := range strings.Split(val, ",") {
+			if strings.TrimSpace(kv) == "" {
+				continue
+			}
+			k, v, ok := strings.Cut(kv, "=")
+			// The next item of the key's list
+			if !ok && list && key.IsValid() {
+				m.SetMapIndex(key, reflect.Append(m.MapIndex(key), reflect.ValueOf(strings.TrimSpace(kv))))
+				continue
+			}
+			if !ok {
+				return fmt.Errorf("expected key=value: %s", kv)
+			}
+			key = reflect.ValueOf(strings.TrimSpace(k))
+			elem := reflect.ValueOf(strings.TrimSpace(v))
+			if list {
+				elem = reflect.ValueOf(splitList(v))
+			}
+			m.SetMapIndex(key, elem)
+		}
+		field.Set(m)
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+	return nil
+}
+
+// splitList splits a comma separated list
+func splitList(val string) []string {
+	var list []string
+	for _, s := range strings.Split(val, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// Schema returns the JSON Schema of the yaml and json config files,
+// docs are the field descriptions keyed by <type>.<field>, e.g. Auth.Mode
+func Schema(docs map[string]string) ([]byte, error) {
+	bot := object(reflect.TypeOf(Bot{}), docs)
+	bot["required"] = []string{"nick", "channels", "email"}
+	schema := map[string]interface{}{
+		"$schema":     "http://json-schema.org/draft-07/schema#",
+		"title":       "newyearsbot config",
+		"description": "The bots, see settings.yaml",
+		"type":        "array",
+		"items":       bot,
+	}
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func object(t reflect.Type, docs map[string]string) map[string]interface{} {
+	props := make(map[string]interface{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := yamlKey(f)
+		prop := property(f.Type, docs)
+		if doc := docs[t.Name()+"."+f.Name]; doc != "" {
+			prop["description"] = doc
+		}
+		props[key] = prop
+		if f.Type.Kind() == reflect.String {
+			props[key+"_file"] = map[string]interface{}{
+				"type":        "string",
+				"description": "Read " + key + " from this file",
+			}
+		}
+	}
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           props,
+		"additionalProperties": false,
+	}
+}
+
+func property(t reflect.Type, docs map[string]string) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": property(t.Elem(), docs)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": property(t.Elem(), docs)}
+	case reflect.Struct:
+		return object(t, docs)
+	default:
+		return map[string]interface{}{"type": "string"}
+	}
+}
+
+// Docs reads the field descriptions for Schema from the doc comments
+// of the struct types in the Go source directories
+func Docs(dirs ...string) (map[string]string, error) {
+	docs := make(map[string]string)
+	fset := token.NewFileSet()
+	skipTests := func(fi os.FileInfo) bool { return !strings.HasSuffix(fi.Name(), "_test.go") }
+	for _, dir := range dirs {
+		pkgs, err := parser.ParseDir(fset, dir, skipTests, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		for _, pkg := range pkgs {
+			ast.Inspect(pkg, func(n ast.Node) bool {
+				spec, ok := n.(*ast.TypeSpec)
+				if !ok {
+					return true
+				}
+				st, ok := spec.Type.(*ast.StructType)
+				if !ok {
+					return false
+				}
+				for _, field := range st.Fields.List {
+					if field.Doc == nil {
+						continue
+					}
+					text := strings.Join(strings.Fields(field.Doc.Text()), " ")
+					for _, name := range field.Names {
+						docs[spec.Name.Name+"."+name.Name] = text
+					}
+				}
+				return false
+			})
+		}
+	}
+	return docs, nil
+}
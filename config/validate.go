@@ -0,0 +1,286 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/badoux/checkmail"
+	"github.com/ugjka/newyearsbot/nyb"
+	"gopkg.in/yaml.v3"
+	"mvdan.cc/xurls/v2"
+)
+
+// Error is a problem with a bot's config
+type Error struct {
+	File  string
+	Entry int
+	// path of the field, e.g. channels[1] or auth.mode
+	Field        string
+	Line, Column int
+	Msg          string
+}
+
+func (e Error) Error() string {
+	pos := ""
+	if e.Line > 0 {
+		pos = fmt.Sprintf("%s:%d:%d: ", e.File, e.Line, e.Column)
+	}
+	field := ""
+	if e.Field != "" {
+		field = e.Field + ": "
+	}
+	return fmt.Sprintf("%sbot %d: %s%s", pos, e.Entry, field, e.Msg)
+}
+
+// Errors are all the problems found in the config
+type Errors []Error
+
+func (e Errors) Error() string {
+	var lines []string
+	for _, err := range e {
+		lines = append(lines, "error: "+err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+var (
+	channelReg = regexp.MustCompile(`^([#&][^\x07\x2C\s]{0,200})$`)
+	serverReg  = regexp.MustCompile(`^\S+:\d+$`)
+	prefixReg  = regexp.MustCompile(`^\W+$`)
+)
+
+// Check validates the config, reporting all the problems at once
+func (c Config) Check() error {
+	if len(c) == 0 {
+		return fmt.Errorf("error: empty or misconfigured config")
+	}
+	var errs Errors
+	states := make(map[string]bool)
+	userFiles := make(map[string]bool)
+	logFiles := make(map[string]nyb.LogConfig)
+	names := make(map[string]bool)
+
+	for i, c := range c {
+		fail := func(field, format string, args ...interface{}) {
+			errs = append(errs, Error{Entry: i, Field: field, Msg: fmt.Sprintf(format, args...)})
+		}
+
+		// Check mandatory inputs
+		if len(c.Channels) == 0 {
+			fail("channels", "no channels defined")
+		}
+		for j, ch := range c.Channels {
+			if !channelReg.MatchString(ch) {
+				fail(fmt.Sprintf("channels[%d]", j), "invalid channel name: %s", ch)
+			}
+		}
+		if c.Nick == "" {
+			fail("nick", "no nick defined")
+		}
+		if len(c.Nick) > 16 {
+			fail("nick", "nick too long")
+		}
+		if c.Email == "" {
+			fail("email", "no email provided")
+		} else if err := checkmail.ValidateFormat(c.Email); err != nil {
+			fail("email", "invalid email address")
+		}
+		// Check optional inputs
+		if c.Server == "" {
+			fail("server", "no irc server defined")
+		} else if !serverReg.MatchString(c.Server) {
+			fail("server", "invalid irc server address")
+		} else if err := nyb.CheckProxy(c.Proxy, c.Server); err != nil {
+			fail("proxy", "%v", err)
+		}
+		for j, f := range c.Fallbacks {
+			field := fmt.Sprintf("fallbacks[%d]", j)
+			if !serverReg.MatchString(f) {
+				fail(field, "invalid fallback server address: %s", f)
+			} else if err := nyb.CheckProxy(c.Proxy, f); err != nil {
+				fail(field, "%v", err)
+			}
+		}
+		if c.Prefix == "" {
+			fail("prefix", "no command prefix defined")
+		} else if !prefixReg.MatchString(c.Prefix) {
+			fail("prefix", "prefix must be non-alphanumeric")
+		}
+		if c.Nominatim == "" {
+			fail("nominatim", "no nominatim server provided")
+		} else if !xurls.Strict().MatchString(c.Nominatim) {
+			fail("nominatim", "invalid nominatim server url")
+		}
+		if err := c.Auth.Check(); err != nil {
+			fail("auth", "%v", err)
+		}
+		// These modes send the auth password in place of the server password
+		switch c.Auth.Mode {
+		case nyb.AuthPass, nyb.AuthSASL, nyb.AuthExternal:
+			if c.Password != "" {
+				fail("password", "server password can't be used with %s auth, set auth.password instead", c.Auth.Mode)
+			}
+		}
+		if (c.Auth.Mode == nyb.AuthExternal || c.Auth.Cert != "") && c.NoSSL {
+			fail("nossl", "client certificates need ssl")
+		}
+		if err := c.TLS.Check(); err != nil {
+			fail("tls", "%v", err)
+		}
+		tls := c.TLS
+		if c.NoSSL && (tls.CA != "" || tls.ServerName != "" || tls.MinVersion != "" ||
+			len(tls.Fingerprints) > 0 || tls.Insecure) {
+			fail("nossl", "tls options need ssl")
+		}
+		if names[c.ID()] {
+			fail("name", "duplicate bot name: %s", c.ID())
+		}
+		names[c.ID()] = true
+		if c.State != "" {
+			if states[c.State] {
+				fail("state", "state file shared by several bots: %s", c.State)
+			}
+			states[c.State] = true
+		}
+		if c.Users != "" {
+			if userFiles[c.Users] {
+				fail("users", "users file shared by several bots: %s", c.Users)
+			}
+			userFiles[c.Users] = true
+		}
+		if err := c.Commands.Check(); err != nil {
+			fail("commands", "%v", err)
+		}
+		var unknown []string
+		for ch := range c.Commands.Disabled {
+			if !joins(c.Channels, ch) {
+				unknown = append(unknown, ch)
+			}
+		}
+		sort.Strings(unknown)
+		for _, ch := range unknown {
+			fail("commands", "commands disabled in a channel the bot doesn't join: %s", ch)
+		}
+		if err := c.Log.Check(); err != nil {
+			fail("log", "%v", err)
+		}
+		// The bots share a log file, it is rotated one way
+		if c.Log.File != "" {
+			if other, ok := logFiles[c.Log.File]; ok &&
+				(other.MaxSize != c.Log.MaxSize || other.MaxBackups != c.Log.MaxBackups) {
+				fail("log", "log file shared with different rotation settings: %s", c.Log.File)
+			} else if !ok {
+				logFiles[c.Log.File] = c.Log
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// joins reports if ch is one of the channels, which can have keys
+func joins(channels []string, ch string) bool {
+	for _, c := range channels {
+		if name, _, _ := strings.Cut(c, ":"); strings.EqualFold(name, ch) {
+			return true
+		}
+	}
+	return false
+}
+
+// strict reports the keys of the entries that aren't config fields,
+// <field>_file is allowed for text fields
+func strict(file string, doc *yaml.Node) Errors {
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.SequenceNode {
+		return nil
+	}
+	var errs Errors
+	for i, node := range doc.Content[0].Content {
+		errs = append(errs, strictFields(file, i, "", node, reflect.TypeOf(Bot{}))...)
+	}
+	return errs
+}
+
+func strictFields(file string, i int, path string, node *yaml.Node, t reflect.Type) Errors {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	fields := make(map[string]reflect.StructField)
+	for j := 0; j < t.NumField(); j++ {
+		fields[yamlKey(t.Field(j))] = t.Field(j)
+	}
+	var errs Errors
+	for j := 0; j+1 < len(node.Content); j += 2 {
+		key, value := node.Content[j], node.Content[j+1]
+		f, ok := fields[key.Value]
+		if !ok {
+			f, ok = fields[strings.TrimSuffix(key.Value, "_file")]
+			ok = ok && strings.HasSuffix(key.Value, "_file") && f.Type.Kind() == reflect.String
+			if ok {
+				continue
+			}
+			errs = append(errs, Error{File: file, Entry: i, Field: path + key.Value,
+				Line: key.Line, Column: key.Column, Msg: "unknown field"})
+			continue
+		}
+		if f.Type.Kind() == reflect.Struct {
+			errs = append(errs, strictFields(file, i, path+key.Value+".", value, f.Type)...)
+		}
+	}
+	return errs
+}
+
+// locate fills in the file positions of the errors
+func locate(file string, doc *yaml.Node, errs Errors) {
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.SequenceNode {
+		return
+	}
+	entries := doc.Content[0].Content
+	for k := range errs {
+		e := &errs[k]
+		if e.Entry >= len(entries) {
+			// Added by the environment
+			continue
+		}
+		e.File = file
+		node := entries[e.Entry]
+		e.Line, e.Column = node.Line, node.Column
+		for _, part := range strings.Split(e.Field, ".") {
+			if part == "" {
+				break
+			}
+			name, index := part, -1
+			if open := strings.IndexByte(part, '['); open >= 0 {
+				name = part[:open]
+				index, _ = strconv.Atoi(strings.Trim(part[open:], "[]"))
+			}
+			node = lookup(node, name)
+			if node == nil {
+				break
+			}
+			if index >= 0 && node.Kind == yaml.SequenceNode && index < len(node.Content) {
+				node = node.Content[index]
+			}
+			e.Line, e.Column = node.Line, node.Column
+		}
+	}
+}
+
+// lookup returns the value of the key in the mapping node
+func lookup(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for j := 0; j+1 < len(node.Content); j += 2 {
+		if node.Content[j].Value == key {
+			return node.Content[j+1]
+		}
+	}
+	return nil
+}
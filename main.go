@@ -5,20 +5,27 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"regexp"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/badoux/checkmail"
 	"github.com/fatih/color"
+	"github.com/ugjka/newyearsbot/audit"
+	"github.com/ugjka/newyearsbot/config"
+	"github.com/ugjka/newyearsbot/metrics"
 	"github.com/ugjka/newyearsbot/nyb"
-	log "gopkg.in/inconshreveable/log15.v2"
+	"github.com/ugjka/newyearsbot/nyb/clock"
 	"gopkg.in/yaml.v3"
-	"mvdan.cc/xurls/v2"
 )
 
 const usage = `
 New Year's Eve IRC party bot
 Announces new years as they happen in each timezone
 
+Set up a bot interactively:
+newyearsbot init [settings.yaml]
+
 CMD Options:
 [mandatory]
 -channels	comma separated list of channels eg. "#test, #test2"
@@ -27,20 +34,38 @@ CMD Options:
 -email		nominatim email
 
 [optional]
--password	irc password
+-password	irc password, or the auth password if -auth is set
+-auth		authentication: pass, sasl, external (SASL with client certificate) or nickserv
+-account	account name for sasl and nickserv (default: nick)
+-cert		client certificate file for CertFP
+-key		client certificate key file (default: same as -cert)
 -server		irc server (default: irc.libera.chat:6697)
+-fallbacks	comma separated list of servers to try when the irc server is unreachable
 -prefix		command prefix (default: !)
 -nossl		disable ssl for irc
+-proxy		proxy for irc and geocoding: socks5://[user:pass@]host:port or http://[user:pass@]host:port
 -nominatim	nominatim server (default: http://nominatim.openstreetmap.org)
 -nolimit	disable flood kick protection
 -colors		enable irc colors
 -debug		debug irc traffic
--yaml		yaml config file
+-logformat	log format: terminal, logfmt or json (default: terminal)
+-logfile	log to a file instead of stderr
+-config		config file: .yaml, .yml, .json or .toml
+-yaml		same as -config
+-check-config	check the config, listing all the problems with their lines, and exit
+-audit		append announcements to this audit log file
+-state		remember the announced zones in this file between restarts
+-users		remember the users' locations in this file
+-control	unix socket to list, start, stop and reload the bots
+-metrics	serve prometheus metrics on this address (e.g. localhost:9090)
+-simulate	rehearse the new year's eve on a virtual clock
+-simstart	virtual clock start time in RFC3339 (default: a minute before the first new year)
+-simspeed	virtual clock speed multiplier (default: 60)
+
+Every config field can be set with NYB_<bot index>_<FIELD> environment variables,
+e.g. NYB_0_PASSWORD or NYB_0_AUTH_PASSWORD, add _FILE to read the value from a file
 
 `
-const SET_NOMINATIM_SERVER = "https://nominatim.openstreetmap.org"
-const SET_LIBERA_SERVER = "irc.libera.chat:6697"
-const SET_PREFIX = "!"
 
 func main() {
 	var channels nyb.Channels
@@ -50,28 +75,58 @@ func main() {
 	nick := flag.String("nick", "", "irc nick")
 	email := flag.String("email", "", "nominatim email")
 	server := flag.String("server", "irc.snoonet.org:6697", "irc server")
+	fallbacks := flag.String("fallbacks", "", "fallback irc servers")
 	// Optional
 	password := flag.String("password", "", "irc password")
-	prefix := flag.String("prefix", SET_PREFIX, "command prefix")
+	authMode := flag.String("auth", "", "authentication mode")
+	account := flag.String("account", "", "account name")
+	cert := flag.String("cert", "", "client certificate file")
+	key := flag.String("key", "", "client certificate key file")
+	prefix := flag.String("prefix", config.DefaultPrefix, "command prefix")
 	nossl := flag.Bool("nossl", false, "disable ssl for irc")
-	nominatim := flag.String("nominatim", SET_NOMINATIM_SERVER, "nominatim server")
+	proxy := flag.String("proxy", "", "proxy url")
+	nominatim := flag.String("nominatim", config.DefaultNominatim, "nominatim server")
 	nolimit := flag.Bool("nolimit", false, "disable limit bot replies.")
 	colors := flag.Bool("colors", false, "enable irc colors")
 	debug := flag.Bool("debug", false, "debug irc traffic")
-	configYAML := flag.String("yaml", "", "use yaml settings file")
+	logFormat := flag.String("logformat", "", "log format")
+	logFile := flag.String("logfile", "", "log file")
+	configFile := flag.String("config", "", "config file")
+	flag.StringVar(configFile, "yaml", "", "use yaml settings file")
+	auditFile := flag.String("audit", "", "audit log file")
+	stateFile := flag.String("state", "", "state file")
+	usersFile := flag.String("users", "", "users file")
+	controlSocket := flag.String("control", "", "control socket")
+	checkConfig := flag.Bool("check-config", false, "check the config and exit")
+	metricsAddr := flag.String("metrics", "", "prometheus metrics listen address")
+	simulate := flag.Bool("simulate", false, "rehearse on a virtual clock")
+	simStart := flag.String("simstart", "", "virtual clock start time")
+	simSpeed := flag.Float64("simspeed", 60, "virtual clock speed multiplier")
 
 	green := color.New(color.FgGreen)
 	flag.Usage = func() {
 		green.Fprint(os.Stderr, usage)
 	}
+	if len(os.Args) > 1 && os.Args[1] == "init" {
+		path := "settings.yaml"
+		if len(os.Args) > 2 {
+			path = os.Args[2]
+		}
+		if err := setup(os.Stdin, os.Stdout, path); err != nil {
+			color.New(color.FgHiRed).Fprintln(os.Stderr, "init:", err)
+			os.Exit(1)
+		}
+		return
+	}
 	flag.Parse()
 
-	c := config{
+	c := config.Config{
 		{
 			Nick:      *nick,
 			Channels:  channels,
 			Server:    *server,
 			NoSSL:     *nossl,
+			Proxy:     *proxy,
 			Password:  *password,
 			Prefix:    *prefix,
 			Email:     *email,
@@ -79,139 +134,192 @@ func main() {
 			NoLimit:   *nolimit,
 			Colors:    *colors,
 			Debug:     *debug,
+			Audit:     *auditFile,
+			State:     *stateFile,
+			Users:     *usersFile,
+			Log: nyb.LogConfig{
+				Format: *logFormat,
+				File:   *logFile,
+			},
 		},
 	}
 
-	red := color.New(color.FgHiRed)
+	if *fallbacks != "" {
+		for _, f := range strings.Split(*fallbacks, ",") {
+			c[0].Fallbacks = append(c[0].Fallbacks, strings.TrimSpace(f))
+		}
+	}
 
-	if *configYAML != "" {
-		data, err := os.ReadFile(*configYAML)
-		if err != nil {
-			red.Fprintln(os.Stderr, "yaml file: ", err)
-			os.Exit(1)
+	if *authMode != "" {
+		c[0].Auth = nyb.Auth{
+			Mode:     *authMode,
+			User:     *account,
+			Password: *password,
+			Cert:     *cert,
+			Key:      *key,
 		}
-		c = config{}
-		err = yaml.Unmarshal(data, &c)
-		if err != nil {
-			red.Fprintln(os.Stderr, "yaml file: ", err)
-			os.Exit(1)
-		}
-		for i := range c {
-			if c[i].Nominatim == "" {
-				c[i].Nominatim = SET_NOMINATIM_SERVER
-			}
-			if c[i].Server == "" {
-				c[i].Server = SET_LIBERA_SERVER
-			}
-			if c[i].Prefix == "" {
-				c[i].Prefix = SET_PREFIX
-			}
+		c[0].Password = ""
+	} else if *cert != "" {
+		c[0].Auth = nyb.Auth{
+			Cert: *cert,
+			Key:  *key,
 		}
 	}
 
-	err := check(c)
+	red := color.New(color.FgHiRed)
+
+	var err error
+	if *configFile != "" {
+		c, err = config.Load(*configFile)
+		if _, invalid := err.(config.Errors); err != nil && !invalid {
+			err = fmt.Errorf("config file: %v", err)
+		}
+	} else {
+		c, err = config.ApplyEnv(c)
+		if err == nil {
+			c.Defaults()
+			err = c.Check()
+		}
+	}
 	if err != nil {
 		red.Fprintln(os.Stderr, err)
-		if *configYAML == "" {
+		if *configFile == "" {
 			flag.Usage()
 		}
 		os.Exit(1)
 	}
-	var bots []*nyb.Settings
-	for _, c := range c {
-		bots = append(bots,
-			nyb.New(
-				&nyb.Settings{
-					Nick:      c.Nick,
-					Channels:  c.Channels,
-					Server:    c.Server,
-					SSL:       !c.NoSSL,
-					Password:  c.Password,
-					Prefix:    c.Prefix,
-					Email:     c.Email,
-					Nominatim: c.Nominatim,
-					Limit:     !c.NoLimit,
-					Colors:    c.Colors,
-				},
-			),
-		)
-	}
-
-	for i, bot := range bots {
-		if c[i].Debug {
-			bot.LogLvl(log.LvlDebug)
-		} else {
-			bot.LogLvl(log.LvlInfo)
+	if *checkConfig {
+		green.Fprintf(os.Stdout, "config ok: %d bots\n", len(c))
+		return
+	}
+	var clk clock.Clock = clock.Real{}
+	if *simulate {
+		var start time.Time
+		if *simStart != "" {
+			start, err = time.Parse(time.RFC3339, *simStart)
+			if err != nil {
+				red.Fprintln(os.Stderr, "simstart: ", err)
+				os.Exit(1)
+			}
+		}
+		if *simSpeed <= 0 {
+			red.Fprintln(os.Stderr, "simspeed: must be positive")
+			os.Exit(1)
 		}
-		go bot.Start()
+		clk = nyb.Simulation(start, *simSpeed)
 	}
-	select {}
-}
 
-type config []struct {
-	Nick      string
-	Channels  []string
-	Server    string
-	NoSSL     bool
-	Password  string
-	Prefix    string
-	Email     string
-	Nominatim string
-	NoLimit   bool
-	Colors    bool
-	Debug     bool
-}
-
-func check(c config) error {
-	if len(c) == 0 {
-		return fmt.Errorf("empty or misconfigured yaml")
+	if *metricsAddr != "" {
+		go func() {
+			err := metrics.ListenAndServe(*metricsAddr)
+			red.Fprintln(os.Stderr, "metrics: ", err)
+			os.Exit(1)
+		}()
 	}
 
-	for _, c := range c {
-
-		// Check mandatory inputs
-		if len(c.Channels) == 0 {
-			return fmt.Errorf("error: no channels defined")
-		}
-		channelReg := regexp.MustCompile(`^([#&][^\x07\x2C\s]{0,200})$`)
-		for _, ch := range c.Channels {
-			if !channelReg.MatchString(ch) {
-				return fmt.Errorf("error: invalid channel name: %s", ch)
+	sup := &nyb.Supervisor{
+		Load: func() ([]nyb.Bot, error) {
+			// The flags can't change, reloading only makes sense with a config file
+			if *configFile == "" {
+				return bots(c, clk), nil
 			}
+			c, err := config.Load(*configFile)
+			if err != nil {
+				return nil, err
+			}
+			return bots(c, clk), nil
+		},
+	}
+	if err := sup.Run(); err != nil {
+		red.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *controlSocket != "" {
+		ln, err := sup.Control(*controlSocket)
+		if err != nil {
+			red.Fprintln(os.Stderr, "control socket: ", err)
+			os.Exit(1)
 		}
-		if c.Nick == "" {
-			return fmt.Errorf("error: no nick defined")
-		}
-		if len(c.Nick) > 16 {
-			return fmt.Errorf("error: nick too long")
-		}
-		if c.Email == "" {
-			return fmt.Errorf("error: no email provided")
-		}
-		if err := checkmail.ValidateFormat(c.Email); err != nil {
-			return fmt.Errorf("error: invalid email address")
-		}
-		// Check optional inputs
-		if c.Server == "" {
-			return fmt.Errorf("error: no irc server defined")
-		}
-		serverReg := regexp.MustCompile(`^\S+:\d+$`)
-		if !serverReg.MatchString(c.Server) {
-			return fmt.Errorf("error: invalid irc server address")
-		}
-		if c.Prefix == "" {
-			return fmt.Errorf("error: no command prefix defined")
-		}
-		prefixReg := regexp.MustCompile(`^\W+$`)
-		if !prefixReg.MatchString(c.Prefix) {
-			return fmt.Errorf("error: prefix must be non-alphanumeric")
-		}
-		if c.Nominatim == "" {
-			return fmt.Errorf("error: no nominatim server provided")
-		}
-		if !xurls.Strict().MatchString(c.Nominatim) {
-			return fmt.Errorf("error: invalid nominatim server url")
+		defer ln.Close()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			if err := sup.Reload(); err != nil {
+				red.Fprintln(os.Stderr, "reload: ", err)
+			}
+			continue
 		}
+		sup.StopAll()
+		// Let the bots quit
+		time.Sleep(time.Second)
+		return
+	}
+}
+
+// bots returns the supervised bots of the config
+// settings are the bot's settings from its config entry
+func settings(c config.Bot) *nyb.Settings {
+	return &nyb.Settings{
+		Nick:      c.Nick,
+		Channels:  c.Channels,
+		Server:    c.Server,
+		Fallbacks: c.Fallbacks,
+		SSL:       !c.NoSSL,
+		Password:  c.Password,
+		Prefix:    c.Prefix,
+		Email:     c.Email,
+		Nominatim: c.Nominatim,
+		Limit:     !c.NoLimit,
+		Colors:    c.Colors,
+		Auth:      c.Auth,
+		TLS:       c.TLS,
+		Proxy:     c.Proxy,
+		State:     c.State,
+		Users:     c.Users,
+		Commands:  c.Commands,
+	}
+}
+
+func bots(c config.Config, clk clock.Clock) []nyb.Bot {
+	var bots []nyb.Bot
+	for _, c := range c {
+		c := c
+		// The bot is restarted on reload when its entry changes
+		fingerprint, _ := yaml.Marshal(c)
+		bots = append(bots, nyb.Bot{
+			Name:   c.ID(),
+			Config: string(fingerprint),
+			New: func() (*nyb.Settings, error) {
+				var auditLog *audit.Log
+				if c.Audit != "" {
+					var err error
+					auditLog, err = audit.Open(c.Audit)
+					if err != nil {
+						return nil, fmt.Errorf("audit log: %v", err)
+					}
+				}
+				s := settings(c)
+				s.Audit = auditLog
+				s.Clock = clk
+				bot := nyb.New(s)
+				logging := c.Log
+				// debug is a shorthand for the irc debug level
+				if c.Debug && logging.Levels[nyb.LogIRC] == "" {
+					levels := map[string]string{nyb.LogIRC: "debug"}
+					for k, v := range logging.Levels {
+						levels[k] = v
+					}
+					logging.Levels = levels
+				}
+				if err := bot.Logging(logging); err != nil {
+					return nil, fmt.Errorf("logging: %v", err)
+				}
+				return bot, nil
+			},
+		})
 	}
-	return nil
+	return bots
 }
@@ -0,0 +1,341 @@
+// Package metrics is a small Prometheus compatible metrics registry
+// that exports counters, gauges and histograms in the text exposition format
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry holds a set of metrics
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+// Default is the registry used by the package level constructors
+var Default = &Registry{}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, v := range r.metrics {
+		if v.name() == m.name() {
+			panic("metrics: duplicate metric " + m.name())
+		}
+	}
+	r.metrics = append(r.metrics, m)
+}
+
+// Write writes all the metrics in the text exposition format
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	metrics := append([]metric{}, r.metrics...)
+	r.mu.Unlock()
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].name() < metrics[j].name()
+	})
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// ServeHTTP satisfies the http.Handler interface
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Write(w)
+}
+
+// Handler returns the /metrics handler for the default registry
+func Handler() http.Handler {
+	return Default
+}
+
+// ListenAndServe serves the default registry on addr under /metrics
+func ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Default)
+	return http.ListenAndServe(addr, mux)
+}
+
+// desc is the common part of every metric
+type desc struct {
+	fqname string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) name() string {
+	return d.fqname
+}
+
+func (d *desc) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.fqname, escape(d.help, false))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.fqname, d.typ)
+}
+
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d",
+			d.fqname, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func (d *desc) pairs(key string, extra ...string) string {
+	var values []string
+	if len(d.labels) > 0 {
+		values = strings.Split(key, "\xff")
+	}
+	var x []string
+	for i, l := range d.labels {
+		x = append(x, fmt.Sprintf("%s=\"%s\"", l, escape(values[i], true)))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		x = append(x, fmt.Sprintf("%s=\"%s\"", extra[i], extra[i+1]))
+	}
+	if len(x) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(x, ",") + "}"
+}
+
+func escape(s string, quotes bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quotes {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return s
+}
+
+func format(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]*float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// value is a labeled set of float values shared by counters and gauges
+type value struct {
+	desc
+	mu     sync.Mutex
+	values map[string]*float64
+}
+
+func (v *value) add(delta float64, labels []string) {
+	key := v.key(labels)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.values[key]; !ok {
+		v.values[key] = new(float64)
+	}
+	*v.values[key] += delta
+}
+
+func (v *value) set(val float64, labels []string) {
+	key := v.key(labels)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.values[key]; !ok {
+		v.values[key] = new(float64)
+	}
+	*v.values[key] = val
+}
+
+func (v *value) get(labels []string) float64 {
+	key := v.key(labels)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if p, ok := v.values[key]; ok {
+		return *p
+	}
+	return 0
+}
+
+func (v *value) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.header(w)
+	for _, k := range sortedKeys(v.values) {
+		fmt.Fprintf(w, "%s%s %s\n", v.fqname, v.pairs(k), format(*v.values[k]))
+	}
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	value
+}
+
+// NewCounter registers a new counter in the default registry
+func NewCounter(name, help string, labels ...string) *Counter {
+	return Default.NewCounter(name, help, labels...)
+}
+
+// NewCounter registers a new counter in the registry
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{value{
+		desc:   desc{fqname: name, help: help, typ: "counter", labels: labels},
+		values: make(map[string]*float64),
+	}}
+	r.register(c)
+	return c
+}
+
+// Inc increments the counter for the given label values
+func (c *Counter) Inc(labels ...string) {
+	c.value.add(1, labels)
+}
+
+// Add adds delta to the counter, negative values are ignored
+func (c *Counter) Add(delta float64, labels ...string) {
+	if delta < 0 {
+		return
+	}
+	c.value.add(delta, labels)
+}
+
+// Get returns the current value for the given label values
+func (c *Counter) Get(labels ...string) float64 {
+	return c.value.get(labels)
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	value
+}
+
+// NewGauge registers a new gauge in the default registry
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return Default.NewGauge(name, help, labels...)
+}
+
+// NewGauge registers a new gauge in the registry
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{value{
+		desc:   desc{fqname: name, help: help, typ: "gauge", labels: labels},
+		values: make(map[string]*float64),
+	}}
+	r.register(g)
+	return g
+}
+
+// Set sets the gauge for the given label values
+func (g *Gauge) Set(val float64, labels ...string) {
+	g.value.set(val, labels)
+}
+
+// Add adds delta to the gauge
+func (g *Gauge) Add(delta float64, labels ...string) {
+	g.value.add(delta, labels)
+}
+
+// Get returns the current value for the given label values
+func (g *Gauge) Get(labels ...string) float64 {
+	return g.value.get(labels)
+}
+
+// Histogram samples observations into buckets
+type Histogram struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*series
+}
+
+type series struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers a new histogram in the default registry
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return Default.NewHistogram(name, help, buckets, labels...)
+}
+
+// NewHistogram registers a new histogram in the registry.
+// Buckets are upper bounds and must be sorted in increasing order
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		desc:    desc{fqname: name, help: help, typ: "histogram", labels: labels},
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	r.register(h)
+	return h
+}
+
+// Observe adds a single observation to the histogram
+func (h *Histogram) Observe(val float64, labels ...string) {
+	key := h.key(labels)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &series{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, b := range h.buckets {
+		if val <= b {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += val
+}
+
+// Count returns the number of observations for the given label values
+func (h *Histogram) Count(labels ...string) uint64 {
+	key := h.key(labels)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, ok := h.series[key]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := h.series[k]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.fqname, h.pairs(k, "le", format(b)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.fqname, h.pairs(k, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.fqname, h.pairs(k), format(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.fqname, h.pairs(k), s.count)
+	}
+}
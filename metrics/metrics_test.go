@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	r := &Registry{}
+	c := r.NewCounter("test_total", "A counter", "channel")
+	g := r.NewGauge("test_up", "A gauge")
+	h := r.NewHistogram("test_seconds", "A histogram", []float64{1, 5})
+
+	c.Inc("#test")
+	c.Add(2, "#test")
+	c.Add(-1, "#test")
+	c.Inc(`#"quoted"`)
+	g.Set(1)
+	h.Observe(0.5)
+	h.Observe(3)
+
+	var buf bytes.Buffer
+	r.Write(&buf)
+	expected := `# HELP test_seconds A histogram
+# TYPE test_seconds histogram
+test_seconds_bucket{le="1"} 1
+test_seconds_bucket{le="5"} 2
+test_seconds_bucket{le="+Inf"} 2
+test_seconds_sum 3.5
+test_seconds_count 2
+# HELP test_total A counter
+# TYPE test_total counter
+test_total{channel="#\"quoted\""} 1
+test_total{channel="#test"} 3
+# HELP test_up A gauge
+# TYPE test_up gauge
+test_up 1
+`
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+	if c.Get("#test") != 3 {
+		t.Errorf("expected 3; got %v", c.Get("#test"))
+	}
+	if h.Count() != 2 {
+		t.Errorf("expected 2; got %v", h.Count())
+	}
+}
+
+func TestDuplicate(t *testing.T) {
+	r := &Registry{}
+	r.NewCounter("dup_total", "")
+	defer func() {
+		if recover() == nil {
+			t.Error("duplicate metric did not panic")
+		}
+	}()
+	r.NewGauge("dup_total", "")
+}
@@ -6,236 +6,237 @@ import (
 	"strings"
 	"time"
 
-	"github.com/ugjka/go-tz/v2"
 	kitty "github.com/ugjka/kittybot"
 )
 
-const helpMsg = "Commands: '%shny <location>', '%stime <location>', '%snext', '%sprevious', '%sremaining', '%shelp', '%ssource'"
-
 func (bot *Settings) addTriggers() {
-	irc := bot.irc
 
-	//Log Notices
-	irc.AddTrigger(kitty.Trigger{
+	//Identify after registering
+	bot.addTrigger(kitty.Trigger{
 		Condition: func(b *kitty.Bot, m *kitty.Message) bool {
-			return m.Command == "NOTICE"
+			return m.Command == "001"
 		},
 		Action: func(b *kitty.Bot, m *kitty.Message) {
-			b.Info("[NOTICE] " + m.Content)
+			bot.registered()
 		},
 	})
 
-	//Trigger for !source
-	irc.AddTrigger(kitty.Trigger{
+	//Announce the zones missed while disconnected
+	bot.addTrigger(kitty.Trigger{
 		Condition: func(b *kitty.Bot, m *kitty.Message) bool {
-			return m.Command == "PRIVMSG" &&
-				strings.HasPrefix(normalize(m.Content), bot.Prefix+"source")
+			return m.Command == "JOIN" && strings.EqualFold(m.Name, b.Prefix().Name)
 		},
 		Action: func(b *kitty.Bot, m *kitty.Message) {
-			b.Reply(m, "https://github.com/ugjka/newyearsbot")
+			bot.catchUp(m.Param(0))
 		},
 	})
 
-	//Trigger for !help
-	irc.AddTrigger(kitty.Trigger{
+	//NickServ fallback when SASL fails
+	bot.addTrigger(kitty.Trigger{
 		Condition: func(b *kitty.Bot, m *kitty.Message) bool {
-			return m.Command == "PRIVMSG" &&
-				strings.HasPrefix(normalize(m.Content), bot.Prefix+"help") ||
-				normalize(m.Content) == bot.Prefix+"hny"
+			return m.Command == "904" || m.Command == "905"
 		},
 		Action: func(b *kitty.Bot, m *kitty.Message) {
-			b.Info("Querying help...")
-			b.Reply(m, fmt.Sprintf(helpMsg, bot.Prefix, bot.Prefix, bot.Prefix, bot.Prefix, bot.Prefix, bot.Prefix, bot.Prefix))
+			bot.saslFailed()
 		},
 	})
 
-	//Trigger for !next
-	irc.AddTrigger(kitty.Trigger{
+	//Log Notices
+	bot.addTrigger(kitty.Trigger{
 		Condition: func(b *kitty.Bot, m *kitty.Message) bool {
-			return m.Command == "PRIVMSG" &&
-				strings.HasPrefix(normalize(m.Content), bot.Prefix+"next")
+			return m.Command == "NOTICE"
 		},
 		Action: func(b *kitty.Bot, m *kitty.Message) {
-			b.Info("Querying next...")
-			dur := time.Minute * time.Duration(bot.next.Offset*60)
-			if now().UTC().Add(dur).After(bot.target) {
-				b.Reply(m, fmt.Sprintf("No more next, %d is here AoE", bot.target.Year()))
-				return
-			}
-			hdur := humanDur(bot.target.Sub(now().UTC().Add(dur)))
-			hdur = bot.col(hdur)
-			var next = bot.col("Next New Year") + " in "
-			max := b.ReplyMaxSize(m)
-			max -= len(next)
-			max -= len(hdur)
-			max -= 4
-			b.Reply(m, next+hdur+" in "+bot.next.Format(max, bot.Colors))
+			b.Info("notice", "from", m.From, "text", m.Content)
 		},
 	})
 
-	//Trigger for !previous
-	irc.AddTrigger(kitty.Trigger{
+	//Commands
+	bot.addTrigger(kitty.Trigger{
 		Condition: func(b *kitty.Bot, m *kitty.Message) bool {
-			return m.Command == "PRIVMSG" &&
-				strings.HasPrefix(normalize(m.Content), bot.Prefix+"prev")
+			cmd, _ := bot.route(m)
+			return cmd != nil
 		},
 		Action: func(b *kitty.Bot, m *kitty.Message) {
-			b.Info("Querying previous...")
-			dur := time.Minute * time.Duration(bot.previous.Offset*60)
-			hdur := humanDur(now().UTC().Add(dur).Sub(bot.target))
-			if bot.previous.Offset == -12 {
-				hdur = humanDur(now().UTC().Add(dur).Sub(bot.target.AddDate(-1, 0, 0)))
-			}
-			hdur = bot.col(hdur)
-			var prev = bot.col("Previous New Year") + " was "
-			max := b.ReplyMaxSize(m)
-			max -= len(prev)
-			max -= len(hdur)
-			max -= 8
-			b.Reply(m, prev+hdur+" ago in "+bot.previous.Format(max, bot.Colors))
+			bot.dispatch(m)
 		},
 	})
+}
 
-	//Trigger for !remaining
-	irc.AddTrigger(kitty.Trigger{
-		Condition: func(b *kitty.Bot, m *kitty.Message) bool {
-			return m.Command == "PRIVMSG" &&
-				strings.HasPrefix(normalize(m.Content), bot.Prefix+"remaining")
-		},
-		Action: func(b *kitty.Bot, m *kitty.Message) {
-			b.Info("Querying remaining...")
-			plural := "s"
-			if bot.remaining == 1 {
-				plural = ""
-			}
-			pct := ((float64(len(bot.zones)) - float64(bot.remaining)) / float64(len(bot.zones)) * 100)
-			b.Reply(m, fmt.Sprintf("%d timezone%s remaining. %.2f%% are in the new year", bot.remaining, plural, pct))
-		},
-	})
+func (bot *Settings) sourceCommand(m *kitty.Message, arg string) {
+	bot.reply(m, "https://github.com/ugjka/newyearsbot")
+}
 
-	//Trigger for time in location
-	irc.AddTrigger(kitty.Trigger{
-		Condition: func(b *kitty.Bot, m *kitty.Message) bool {
+func (bot *Settings) helpCommand(m *kitty.Message, arg string) {
+	if arg != "" {
+		bot.reply(m, bot.commandHelp(strings.Fields(arg)[0], m.To))
+		return
+	}
+	bot.reply(m, bot.help(m.To))
+}
 
-			return m.Command == "PRIVMSG" &&
-				strings.HasPrefix(normalize(m.Content), bot.Prefix+"time ")
-		},
-		Action: func(b *kitty.Bot, m *kitty.Message) {
-			b.Info("Querying time...")
-			result, err := bot.time(normalize(m.Content)[len(bot.Prefix)+len("time")+1:])
-			if err == errNoZone || err == errNoPlace {
-				b.Warn("Query error: " + err.Error())
-				b.Reply(m, err.Error())
-				return
-			}
-			if err != nil {
-				b.Warn("Query error: " + err.Error())
-				b.Reply(m, "Some error occurred!")
-				return
-			}
-			b.Reply(m, result)
-		},
-	})
+func (bot *Settings) nextCommand(m *kitty.Message, arg string) {
+	dur := time.Minute * time.Duration(bot.next.Offset*60)
+	if bot.now().UTC().Add(dur).After(bot.target) {
+		bot.reply(m, fmt.Sprintf("No more next, %d is here AoE", bot.target.Year()))
+		return
+	}
+	hdur := humanDur(bot.target.Sub(bot.now().UTC().Add(dur)))
+	hdur = bot.col(hdur)
+	var next = bot.col("Next New Year") + " in "
+	max := bot.irc.ReplyMaxSize(m)
+	max -= len(next)
+	max -= len(hdur)
+	max -= 4
+	bot.reply(m, next+hdur+" in "+bot.next.Format(max, bot.Colors))
+}
 
-	//Trigger for UTC time
-	irc.AddTrigger(kitty.Trigger{
-		Condition: func(b *kitty.Bot, m *kitty.Message) bool {
-			return m.Command == "PRIVMSG" &&
-				normalize(m.Content) == bot.Prefix+"time"
-		},
-		Action: func(b *kitty.Bot, m *kitty.Message) {
-			b.Info("Querying time...")
-			result := "Time is " + now().UTC().Format("Mon Jan 2 15:04:05 -0700 MST 2006")
-			b.Reply(m, result)
-		},
-	})
+func (bot *Settings) previousCommand(m *kitty.Message, arg string) {
+	dur := time.Minute * time.Duration(bot.previous.Offset*60)
+	hdur := humanDur(bot.now().UTC().Add(dur).Sub(bot.target))
+	if bot.previous.Offset == -12 {
+		hdur = humanDur(bot.now().UTC().Add(dur).Sub(bot.target.AddDate(-1, 0, 0)))
+	}
+	hdur = bot.col(hdur)
+	var prev = bot.col("Previous New Year") + " was "
+	max := bot.irc.ReplyMaxSize(m)
+	max -= len(prev)
+	max -= len(hdur)
+	max -= 8
+	bot.reply(m, prev+hdur+" ago in "+bot.previous.Format(max, bot.Colors))
+}
 
-	//Trigger for new year in location
-	irc.AddTrigger(kitty.Trigger{
-		Condition: func(b *kitty.Bot, m *kitty.Message) bool {
-			return m.Command == "PRIVMSG" &&
-				strings.HasPrefix(normalize(m.Content), bot.Prefix+"hny ")
-		},
-		Action: func(b *kitty.Bot, m *kitty.Message) {
-			result, err := bot.newYear(normalize(m.Content)[len(bot.Prefix)+len("hny")+1:])
-			if err == errNoZone || err == errNoPlace {
-				b.Warn("Query error: " + err.Error())
-				b.Reply(m, err.Error())
-				return
-			}
-			if err != nil {
-				b.Warn("Query error: " + err.Error())
-				b.Reply(m, "Some error occurred!")
-				return
-			}
-
-			b.Reply(m, result)
-		},
-	})
+func (bot *Settings) remainingCommand(m *kitty.Message, arg string) {
+	plural := "s"
+	if bot.remaining == 1 {
+		plural = ""
+	}
+	pct := ((float64(len(bot.zones)) - float64(bot.remaining)) / float64(len(bot.zones)) * 100)
+	bot.reply(m, fmt.Sprintf("%d timezone%s remaining. %.2f%% are in the new year", bot.remaining, plural, pct))
 }
 
-var (
-	errNoZone  = errors.New("couldn't get timezone for that location")
-	errNoPlace = errors.New("couldn't find that place")
-)
+func (bot *Settings) zoneCommand(m *kitty.Message, arg string) {
+	bot.reply(m, bot.zone(arg, bot.irc.ReplyMaxSize(m)))
+}
+
+func (bot *Settings) whereCommand(m *kitty.Message, arg string) {
+	bot.reply(m, bot.where(arg))
+}
+
+func (bot *Settings) scheduleCommand(m *kitty.Message, arg string) {
+	bot.schedule(m, arg)
+}
 
-func (bot *Settings) time(location string) (string, error) {
-	bot.irc.Info("Querying location: " + location)
-	res, err := NominatimFetcher(bot.Email, bot.Nominatim, location)
+// countdownCommand counts down in the location or at the saved location
+func (bot *Settings) countdownCommand(m *kitty.Message, arg string) {
+	p, ok, err := bot.userPlace(m)
 	if err != nil {
-		bot.irc.Warn("Nominatim error: " + err.Error())
-		return "", err
+		bot.queryError(m, err)
+		return
 	}
-	if len(res) == 0 {
-		return "", errNoPlace
+	if !ok {
+		bot.reply(m, fmt.Sprintf("Usage: %[1]scountdown <location>, or save your location with %[1]ssetlocation <place>", bot.Prefix))
+		return
 	}
-	p := tz.Point{
-		Lat: res[0].Lat,
-		Lon: res[0].Lon,
+	bot.reply(m, bot.countdown(p))
+}
+
+func (bot *Settings) setLocationCommand(m *kitty.Message, arg string) {
+	bot.setLocation(m, arg)
+}
+
+func (bot *Settings) forgetMeCommand(m *kitty.Message, arg string) {
+	bot.forgetMe(m)
+}
+
+func (bot *Settings) notifyCommand(m *kitty.Message, arg string) {
+	if arg != "" && !strings.EqualFold(arg, "off") {
+		bot.reply(m, "Usage: "+bot.usage(bot.router.names["notifyme"]))
+		return
 	}
-	tzid, err := tz.GetZone(p)
+	bot.notify(m, arg)
+}
+
+// timeCommand tells the time in the location or at the saved location, UTC without either
+func (bot *Settings) timeCommand(m *kitty.Message, arg string) {
+	p, ok, err := bot.userPlace(m)
 	if err != nil {
-		return "", errNoZone
+		bot.queryError(m, err)
+		return
 	}
-	zone, err := time.LoadLocation(tzid[0])
-	if err != nil {
-		return "", errNoZone
+	if !ok {
+		bot.reply(m, "Time is "+bot.now().UTC().Format("Mon Jan 2 15:04:05 -0700 MST 2006"))
+		return
 	}
-	address := res[0].DisplayName
-	msg := fmt.Sprintf("Time in %s is %s", address, now().In(zone).Format("Mon Jan 2 15:04:05 -0700 MST 2006"))
-	return msg, nil
+	bot.reply(m, bot.time(p))
 }
 
-func (bot *Settings) newYear(location string) (string, error) {
-	bot.irc.Info("Querying location: " + location)
-	res, err := NominatimFetcher(bot.Email, bot.Nominatim, location)
+// hnyCommand tells about the New Year in the location or at the saved location, the help without either
+func (bot *Settings) hnyCommand(m *kitty.Message, arg string) {
+	p, ok, err := bot.userPlace(m)
 	if err != nil {
-		bot.irc.Warn("Nominatim error: " + err.Error())
-		return "", err
+		bot.queryError(m, err)
+		return
 	}
-	if len(res) == 0 {
-		return "", errNoPlace
+	if !ok {
+		bot.reply(m, bot.help(m.To))
+		return
 	}
-	p := tz.Point{
-		Lat: res[0].Lat,
-		Lon: res[0].Lon,
+	bot.reply(m, bot.newYear(p))
+}
+
+// queryError replies with the location query's error
+func (bot *Settings) queryError(m *kitty.Message, err error) {
+	if _, ok := err.(ambiguous); ok {
+		bot.reply(m, err.Error())
+		return
 	}
-	tzid, err := tz.GetZone(p)
-	if err != nil {
-		return "", errNoZone
+	bot.irc.Warn("query error", "user", m.From, "channel", m.To, "error", err)
+	if err == errNoZone || err == errNoPlace {
+		bot.reply(m, err.Error())
+		return
 	}
-	zone, err := time.LoadLocation(tzid[0])
+	bot.reply(m, "Some error occurred!")
+}
+
+// command counts and logs a handled command
+func (bot *Settings) command(m *kitty.Message, name string) {
+	commandsCounter.Inc(name)
+	bot.irc.Info("command", "command", name, "user", m.From, "channel", m.To)
+}
+
+// geocode looks up a location using nominatim
+func (bot *Settings) geocode(location string) (NominatimResults, error) {
+	start := time.Now()
+	res, err := fetchNominatim(bot.http, bot.Email, bot.Nominatim, "", "", location, candidates)
 	if err != nil {
-		return "", errNoZone
+		bot.geoLog.Warn("nominatim error", "location", location, "error", err,
+			"latency", time.Since(start))
+		return nil, err
 	}
-	offset := zoneOffset(bot.target, zone)
-	address := res[0].DisplayName
-	if now().UTC().Add(offset).Before(bot.target) {
-		hdur := humanDur(bot.target.Sub(now().UTC().Add(offset)))
+	bot.geoLog.Info("location query", "location", location, "results", len(res),
+		"latency", time.Since(start))
+	return res, nil
+}
+
+var (
+	errNoZone  = errors.New("couldn't get timezone for that location")
+	errNoPlace = errors.New("couldn't find that place")
+)
+
+func (bot *Settings) time(p place) string {
+	return fmt.Sprintf("Time in %s is %s", p.name, bot.now().In(p.zone).Format("Mon Jan 2 15:04:05 -0700 MST 2006"))
+}
+
+func (bot *Settings) newYear(p place) string {
+	offset := zoneOffset(bot.target, p.zone)
+	address := p.name
+	if bot.now().UTC().Add(offset).Before(bot.target) {
+		hdur := humanDur(bot.target.Sub(bot.now().UTC().Add(offset)))
 		const newYearFutureMsg = "New Year in %s will happen in %s"
-		return fmt.Sprintf(newYearFutureMsg, address, hdur), nil
+		return fmt.Sprintf(newYearFutureMsg, address, hdur)
 	}
-	hdur := humanDur(now().UTC().Add(offset).Sub(bot.target))
+	hdur := humanDur(bot.now().UTC().Add(offset).Sub(bot.target))
 	const newYearPastMsg = "New Year in %s happened %s ago"
-	return fmt.Sprintf(newYearPastMsg, address, hdur), nil
+	return fmt.Sprintf(newYearPastMsg, address, hdur)
 }
@@ -0,0 +1,130 @@
+package nyb
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"sync/atomic"
+)
+
+// Authentication modes
+const (
+	// Server password
+	AuthPass = "pass"
+	// SASL PLAIN
+	AuthSASL = "sasl"
+	// SASL EXTERNAL with a client certificate (CertFP)
+	AuthExternal = "external"
+	// NickServ IDENTIFY after connecting
+	AuthNickServ = "nickserv"
+)
+
+// Auth configures how the bot authenticates on the irc network
+type Auth struct {
+	// pass, sasl, external or nickserv, empty for no authentication
+	Mode string
+	// Account name, defaults to the nick
+	User     string
+	Password string
+	// Client certificate and key files for CertFP
+	Cert string
+	Key  string
+	// Identify with NickServ if SASL fails
+	NickServ bool
+}
+
+// Check validates the auth configuration
+func (a Auth) Check() error {
+	switch a.Mode {
+	case "":
+		if a.NickServ {
+			return fmt.Errorf("nickserv fallback needs sasl auth mode")
+		}
+	case AuthPass, AuthSASL, AuthNickServ:
+		if a.Password == "" {
+			return fmt.Errorf("%s auth needs a password", a.Mode)
+		}
+	case AuthExternal:
+		if a.Cert == "" {
+			return fmt.Errorf("external auth needs a client certificate")
+		}
+		if a.NickServ && a.Password == "" {
+			return fmt.Errorf("nickserv fallback needs a password")
+		}
+	default:
+		return fmt.Errorf("unknown auth mode: %s", a.Mode)
+	}
+	if a.Cert != "" || a.Key != "" {
+		if _, err := a.certificate(); err != nil {
+			return fmt.Errorf("client certificate: %v", err)
+		}
+	}
+	return nil
+}
+
+// certificate loads the client certificate,
+// the key can be in the same file as the certificate
+func (a Auth) certificate() (tls.Certificate, error) {
+	key := a.Key
+	if key == "" {
+		key = a.Cert
+	}
+	return tls.LoadX509KeyPair(a.Cert, key)
+}
+
+func (bot *Settings) account() string {
+	if bot.Auth.User != "" {
+		return bot.Auth.User
+	}
+	return bot.Nick
+}
+
+// saslRewrite rewrites kittybot's SASL PLAIN exchange,
+// kittybot always authenticates as its nick using PLAIN
+func (bot *Settings) saslRewrite(line []byte) []byte {
+	const auth = "AUTHENTICATE "
+	if !bytes.HasPrefix(line, []byte(auth)) {
+		return line
+	}
+	arg := string(bytes.TrimSpace(line[len(auth):]))
+	switch {
+	case arg == "PLAIN" && bot.Auth.Mode == AuthExternal:
+		return []byte(auth + "EXTERNAL\r\n")
+	case arg == "PLAIN", arg == "*":
+		return line
+	case bot.Auth.Mode == AuthExternal:
+		return []byte(auth + "+\r\n")
+	}
+	user := bot.account()
+	creds := bytes.Join([][]byte{[]byte(user), []byte(user), []byte(bot.Auth.Password)}, []byte{0})
+	return []byte(auth + base64.StdEncoding.EncodeToString(creds) + "\r\n")
+}
+
+// saslFailed is called when the server rejects SASL
+func (bot *Settings) saslFailed() {
+	if !bot.Auth.NickServ {
+		return
+	}
+	atomic.StoreInt32(&bot.saslFail, 1)
+	// We might have registered already
+	if bot.isConnected() {
+		bot.identify()
+	}
+}
+
+// registered is called after the bot is registered on the server
+func (bot *Settings) registered() {
+	if bot.Auth.Mode == AuthNickServ || atomic.LoadInt32(&bot.saslFail) == 1 {
+		bot.identify()
+	}
+}
+
+// identify identifies with NickServ once per connection
+func (bot *Settings) identify() {
+	if !atomic.CompareAndSwapInt32(&bot.identified, 0, 1) {
+		return
+	}
+	bot.irc.Info("identifying with nickserv", "account", bot.account())
+	bot.irc.Msg("NickServ", "IDENTIFY "+bot.account()+" "+bot.Auth.Password)
+}
@@ -0,0 +1,31 @@
+package nyb
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAuthCheck(t *testing.T) {
+	tt := []struct {
+		auth Auth
+		err  string
+	}{
+		{Auth{}, ""},
+		{Auth{Mode: AuthSASL, Password: "secret", NickServ: true}, ""},
+		{Auth{Mode: AuthSASL}, "needs a password"},
+		{Auth{Mode: AuthNickServ}, "needs a password"},
+		{Auth{Mode: AuthExternal}, "needs a client certificate"},
+		{Auth{Mode: AuthExternal, Cert: "missing.pem"}, "client certificate"},
+		{Auth{NickServ: true}, "nickserv fallback"},
+		{Auth{Mode: "kerberos"}, "unknown auth mode"},
+	}
+	for _, tc := range tt {
+		err := tc.auth.Check()
+		if tc.err == "" && err != nil {
+			t.Errorf("%+v: unexpected error: %v", tc.auth, err)
+		}
+		if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%+v: expected error %q; got %v", tc.auth, tc.err, err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// Package clock abstracts the time source of the bot
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a source of time
+type Clock interface {
+	Now() time.Time
+	NewTimer(dur time.Duration) *Timer
+	Sleep(dur time.Duration)
+}
+
+// Real is the system clock
+type Real struct{}
+
+// Now returns the current time
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+// NewTimer returns a ticker based timer
+func (Real) NewTimer(dur time.Duration) *Timer {
+	return newPollTimer(time.Now, time.Millisecond*100, dur)
+}
+
+// Sleep pauses for the duration
+func (Real) Sleep(dur time.Duration) {
+	time.Sleep(dur)
+}
+
+// Simulated is a virtual clock that runs faster than the real time
+type Simulated struct {
+	start time.Time
+	real  time.Time
+	speed float64
+}
+
+// NewSimulated returns a virtual clock that starts at start
+// and runs speed times faster than the real time
+func NewSimulated(start time.Time, speed float64) *Simulated {
+	if speed <= 0 {
+		speed = 1
+	}
+	return &Simulated{
+		start: start,
+		real:  time.Now(),
+		speed: speed,
+	}
+}
+
+// Now returns the virtual time
+func (s *Simulated) Now() time.Time {
+	return s.start.Add(time.Duration(float64(time.Since(s.real)) * s.speed))
+}
+
+// NewTimer returns a ticker based timer for the virtual time
+func (s *Simulated) NewTimer(dur time.Duration) *Timer {
+	tick := time.Duration(float64(time.Millisecond*100) / s.speed)
+	if tick < time.Millisecond {
+		tick = time.Millisecond
+	}
+	return newPollTimer(s.Now, tick, dur)
+}
+
+// Sleep pauses for the virtual duration
+func (s *Simulated) Sleep(dur time.Duration) {
+	time.Sleep(time.Duration(float64(dur) / s.speed))
+}
+
+// Timer fires by closing C once the Target time is reached
+type Timer struct {
+	C      chan bool
+	Target time.Time
+	stop   chan bool
+	once   sync.Once
+}
+
+// newPollTimer returns a ticker based timer.
+// We need this to take into account time taken in suspend, hibernation or if system time is changed.
+func newPollTimer(now func() time.Time, tick, dur time.Duration) *Timer {
+	t := NewManualTimer(now().UTC().Add(dur))
+	ticker := time.NewTicker(tick)
+	go func(t *Timer) {
+		defer ticker.Stop()
+		for range ticker.C {
+			select {
+			case <-t.stop:
+				return
+			default:
+				if now().UTC().After(t.Target) {
+					t.Fire()
+					return
+				}
+			}
+		}
+	}(t)
+	return t
+}
+
+// NewManualTimer returns a timer that only fires when Fire is called,
+// useful for implementing other clocks
+func NewManualTimer(target time.Time) *Timer {
+	return &Timer{
+		C:      make(chan bool),
+		Target: target,
+		stop:   make(chan bool),
+	}
+}
+
+// Fire fires the timer
+func (t *Timer) Fire() {
+	t.once.Do(func() {
+		close(t.C)
+	})
+}
+
+// Stop stops the timer
+func (t *Timer) Stop() {
+	select {
+	case <-t.stop:
+		return
+	default:
+		close(t.stop)
+	}
+}
+
+// Stopped reports whether the timer has been stopped
+func (t *Timer) Stopped() bool {
+	select {
+	case <-t.stop:
+		return true
+	default:
+		return false
+	}
+}
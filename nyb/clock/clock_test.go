@@ -0,0 +1,63 @@
+package clock_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ugjka/newyearsbot/nyb/clock"
+	"github.com/ugjka/newyearsbot/nyb/clock/clocktest"
+)
+
+func fired(t *clock.Timer) bool {
+	select {
+	case <-t.C:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestFake(t *testing.T) {
+	start := time.Date(2024, time.December, 31, 10, 0, 0, 0, time.UTC)
+	clk := clocktest.New(start)
+	timer := clk.NewTimer(time.Minute)
+	stopped := clk.NewTimer(time.Minute)
+	stopped.Stop()
+	if clk.Pending() != 1 {
+		t.Errorf("expected 1 pending timer; got %d", clk.Pending())
+	}
+	clk.Sleep(time.Second * 59)
+	if fired(timer) {
+		t.Error("timer fired early")
+	}
+	clk.Advance(time.Second)
+	if !fired(timer) {
+		t.Error("timer didn't fire")
+	}
+	if fired(stopped) {
+		t.Error("stopped timer fired")
+	}
+	if !clk.Now().Equal(start.Add(time.Minute)) {
+		t.Errorf("unexpected time: %v", clk.Now())
+	}
+
+	clk.Auto = true
+	timer = clk.NewTimer(time.Hour)
+	if !fired(timer) || !clk.Now().Equal(start.Add(time.Hour+time.Minute)) {
+		t.Error("auto clock didn't advance to the timer")
+	}
+}
+
+func TestSimulated(t *testing.T) {
+	start := time.Date(2024, time.December, 31, 10, 0, 0, 0, time.UTC)
+	clk := clock.NewSimulated(start, 3600)
+	timer := clk.NewTimer(time.Minute * 5)
+	select {
+	case <-timer.C:
+	case <-time.After(time.Second * 5):
+		t.Fatal("simulated timer didn't fire")
+	}
+	if clk.Now().Before(start.Add(time.Minute * 5)) {
+		t.Errorf("timer fired early at %v", clk.Now())
+	}
+}
@@ -0,0 +1,93 @@
+// Package clocktest provides a fake clock for tests
+package clocktest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ugjka/newyearsbot/nyb/clock"
+)
+
+// Fake is a clock that only moves when told to
+type Fake struct {
+	// Auto advances the clock to the target of every new timer
+	// so that code waiting on timers runs through instantly
+	Auto   bool
+	now    time.Time
+	timers []*clock.Timer
+	mu     sync.Mutex
+}
+
+// New returns a fake clock set to start
+func New(start time.Time) *Fake {
+	return &Fake{now: start}
+}
+
+// Now returns the fake time
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// NewTimer returns a timer that fires when the clock is advanced past its target
+func (f *Fake) NewTimer(dur time.Duration) *clock.Timer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := clock.NewManualTimer(f.now.UTC().Add(dur))
+	if f.Auto && t.Target.After(f.now) {
+		f.now = t.Target
+	}
+	f.timers = append(f.timers, t)
+	f.fire()
+	return t
+}
+
+// Sleep advances the clock by dur
+func (f *Fake) Sleep(dur time.Duration) {
+	f.Advance(dur)
+}
+
+// Advance moves the clock forward and fires the due timers
+func (f *Fake) Advance(dur time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(dur)
+	f.fire()
+}
+
+// Set sets the clock and fires the due timers
+func (f *Fake) Set(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = t
+	f.fire()
+}
+
+// Pending returns the number of timers that haven't fired or been stopped
+func (f *Fake) Pending() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var n int
+	for _, t := range f.timers {
+		if !t.Stopped() {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *Fake) fire() {
+	var pending []*clock.Timer
+	for _, t := range f.timers {
+		if t.Stopped() {
+			continue
+		}
+		if !f.now.Before(t.Target) {
+			t.Fire()
+			continue
+		}
+		pending = append(pending, t)
+	}
+	f.timers = pending
+}
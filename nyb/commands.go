@@ -0,0 +1,229 @@
+package nyb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	kitty "github.com/ugjka/kittybot"
+)
+
+// Commands configures the bot's commands
+type Commands struct {
+	// Extra names for the commands, e.g. hny: [ny, newyear]
+	Aliases map[string][]string
+	// Commands turned off in a channel, e.g. "#quiet": [schedule, countdown]
+	Disabled map[string][]string
+}
+
+// command is a bot command
+type command struct {
+	name string
+	// Built in extra names
+	aliases []string
+	// Arguments shown in the help, <required> or [optional]
+	args string
+	// Argument of the usage example
+	example string
+	help    string
+	run     func(bot *Settings, m *kitty.Message, arg string)
+}
+
+// commandList returns the commands in the order of the help
+func commandList() []*command {
+	return []*command{
+		{name: "hny", args: "[location]", example: "Riga",
+			help: "when New Year happens in a location or at your saved location", run: (*Settings).hnyCommand},
+		{name: "time", args: "[location]", example: "Europe/Riga",
+			help: "the time in a location, at your saved location or in UTC", run: (*Settings).timeCommand},
+		{name: "zone", args: "<offset>", example: "+9:30",
+			help: "who celebrates at a UTC offset and when", run: (*Settings).zoneCommand},
+		{name: "where", args: "<country>", example: "Latvia",
+			help: "the UTC offsets of a country and their New Year", run: (*Settings).whereCommand},
+		{name: "schedule", args: "[location]", example: "Riga",
+			help: "privately sends the remaining time zones with their times at the location a page at a time, " +
+				"'more' for the next page", run: (*Settings).scheduleCommand},
+		{name: "countdown", args: "[location]", example: "Riga",
+			help: "hours, minutes and seconds until New Year in a location or at your saved location", run: (*Settings).countdownCommand},
+		{name: "setlocation", args: "<place>", example: "Riga",
+			help: "remembers your location for the commands without one", run: (*Settings).setLocationCommand},
+		{name: "notifyme", args: "[off]",
+			help: "mentions you at your saved location's midnight, privately when asked privately", run: (*Settings).notifyCommand},
+		{name: "forgetme", help: "forgets your saved location", run: (*Settings).forgetMeCommand},
+		{name: "next", help: "the next New Year", run: (*Settings).nextCommand},
+		{name: "previous", aliases: []string{"prev"}, help: "the previous New Year", run: (*Settings).previousCommand},
+		{name: "remaining", help: "the number of time zones still waiting for New Year", run: (*Settings).remainingCommand},
+		{name: "help", args: "[command]", example: "hny", help: "the commands or how to use one", run: (*Settings).helpCommand},
+		{name: "source", help: "the bot's source code", run: (*Settings).sourceCommand},
+	}
+}
+
+// Check validates the commands configuration
+func (c Commands) Check() error {
+	known := make(map[string]bool)
+	taken := make(map[string]bool)
+	for _, cmd := range commandList() {
+		known[cmd.name] = true
+		taken[cmd.name] = true
+		for _, alias := range cmd.aliases {
+			taken[alias] = true
+		}
+	}
+	for _, name := range sortedKeys(c.Aliases) {
+		if !known[name] {
+			return fmt.Errorf("unknown command: %s", name)
+		}
+		for _, alias := range c.Aliases[name] {
+			alias = strings.ToLower(alias)
+			if alias == "" || strings.ContainsAny(alias, " \t") {
+				return fmt.Errorf("invalid alias of %s: %q", name, alias)
+			}
+			if taken[alias] {
+				return fmt.Errorf("alias of %s already names a command: %s", name, alias)
+			}
+			taken[alias] = true
+		}
+	}
+	for _, ch := range sortedKeys(c.Disabled) {
+		if !strings.HasPrefix(ch, "#") && !strings.HasPrefix(ch, "&") {
+			return fmt.Errorf("commands disabled in an invalid channel: %s", ch)
+		}
+		for _, name := range c.Disabled[ch] {
+			if !known[name] {
+				return fmt.Errorf("unknown command disabled in %s: %s", ch, name)
+			}
+		}
+	}
+	return nil
+}
+
+func sortedKeys(m map[string][]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// router finds the commands by their names and aliases
+type router struct {
+	commands []*command
+	names    map[string]*command
+	// Disabled command names by channel
+	disabled map[string]map[string]bool
+}
+
+func newRouter(c Commands) *router {
+	r := &router{
+		commands: commandList(),
+		names:    make(map[string]*command),
+		disabled: make(map[string]map[string]bool),
+	}
+	for _, cmd := range r.commands {
+		r.names[cmd.name] = cmd
+		for _, alias := range append(cmd.aliases, c.Aliases[cmd.name]...) {
+			alias = strings.ToLower(alias)
+			// Checked with the config, a name is never taken over
+			if _, ok := r.names[alias]; !ok {
+				r.names[alias] = cmd
+			}
+		}
+	}
+	for ch, names := range c.Disabled {
+		key := channelKey(ch)
+		if r.disabled[key] == nil {
+			r.disabled[key] = make(map[string]bool)
+		}
+		for _, name := range names {
+			r.disabled[key][name] = true
+		}
+	}
+	return r
+}
+
+// lookup returns the command with the name or alias, nil when it's unknown or disabled in the channel
+func (r *router) lookup(name, ch string) *command {
+	cmd := r.names[strings.ToLower(name)]
+	if cmd == nil || r.disabled[channelKey(ch)][cmd.name] {
+		return nil
+	}
+	return cmd
+}
+
+// route returns the message's command with its argument, the command is nil for other messages
+func (bot *Settings) route(m *kitty.Message) (*command, string) {
+	if m.Command != "PRIVMSG" {
+		return nil, ""
+	}
+	fields := strings.Fields(m.Content)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], bot.Prefix) {
+		return nil, ""
+	}
+	return bot.router.lookup(strings.TrimPrefix(fields[0], bot.Prefix), m.To), args(m.Content)
+}
+
+// dispatch runs the command, the required arguments are checked
+func (bot *Settings) dispatch(m *kitty.Message) {
+	cmd, arg := bot.route(m)
+	if cmd == nil {
+		return
+	}
+	bot.command(m, cmd.name)
+	if (arg == "" && strings.HasPrefix(cmd.args, "<")) || (arg != "" && cmd.args == "") {
+		bot.reply(m, "Usage: "+bot.usage(cmd))
+		return
+	}
+	cmd.run(bot, m, arg)
+}
+
+// syntax is the command with its arguments
+func (bot *Settings) syntax(cmd *command) string {
+	if cmd.args == "" {
+		return bot.Prefix + cmd.name
+	}
+	return bot.Prefix + cmd.name + " " + cmd.args
+}
+
+// usage is the command's syntax with an example
+func (bot *Settings) usage(cmd *command) string {
+	if cmd.example == "" {
+		return bot.syntax(cmd)
+	}
+	return bot.syntax(cmd) + ", e.g. " + bot.Prefix + cmd.name + " " + cmd.example
+}
+
+// help lists the commands enabled in the channel
+func (bot *Settings) help(ch string) string {
+	var list []string
+	for _, cmd := range bot.router.commands {
+		if bot.router.lookup(cmd.name, ch) == nil {
+			continue
+		}
+		list = append(list, "'"+bot.syntax(cmd)+"'")
+	}
+	return "Commands: " + strings.Join(list, ", ")
+}
+
+// commandHelp describes a command with its aliases
+func (bot *Settings) commandHelp(name, ch string) string {
+	cmd := bot.router.lookup(strings.TrimPrefix(name, bot.Prefix), ch)
+	if cmd == nil {
+		return fmt.Sprintf("No such command: %s, see %shelp", name, bot.Prefix)
+	}
+	text := bot.syntax(cmd) + ": " + cmd.help
+	if cmd.example != "" {
+		text += ", e.g. " + bot.Prefix + cmd.name + " " + cmd.example
+	}
+	var aliases []string
+	for alias, c := range bot.router.names {
+		if c == cmd && alias != cmd.name {
+			aliases = append(aliases, bot.Prefix+alias)
+		}
+	}
+	if len(aliases) > 0 {
+		sort.Strings(aliases)
+		text += ", also " + strings.Join(aliases, ", ")
+	}
+	return text
+}
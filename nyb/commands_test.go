@@ -0,0 +1,36 @@
+package nyb
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCommandsCheck(t *testing.T) {
+	tt := []struct {
+		name     string
+		commands Commands
+		err      string
+	}{
+		{"empty", Commands{}, ""},
+		{"valid", Commands{
+			Aliases:  map[string][]string{"hny": {"ny", "NewYear"}, "next": {"soon"}},
+			Disabled: map[string][]string{"#quiet": {"schedule", "help"}},
+		}, ""},
+		{"unknown command", Commands{Aliases: map[string][]string{"party": {"p"}}}, "unknown command: party"},
+		{"taken by a command", Commands{Aliases: map[string][]string{"hny": {"time"}}}, "already names a command: time"},
+		{"taken by an alias", Commands{Aliases: map[string][]string{"next": {"prev"}}}, "already names a command: prev"},
+		{"taken twice", Commands{Aliases: map[string][]string{"hny": {"ny"}, "next": {"NY"}}}, "already names a command: ny"},
+		{"space", Commands{Aliases: map[string][]string{"hny": {"new year"}}}, "invalid alias"},
+		{"not a channel", Commands{Disabled: map[string][]string{"test": {"hny"}}}, "commands disabled in an invalid channel: test"},
+		{"unknown disabled", Commands{Disabled: map[string][]string{"#quiet": {"party"}}}, "unknown command disabled in #quiet: party"},
+	}
+	for _, tc := range tt {
+		err := tc.commands.Check()
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: expected %q; got %v", tc.name, tc.err, err)
+		}
+	}
+}
@@ -13,7 +13,7 @@ import (
 	"time"
 )
 
-var userAgent = fmt.Sprintf("NYE IRC party bot, v%d: https://github.com/ugjka/newyearsbot", now().Year()+1)
+var userAgent = fmt.Sprintf("NYE IRC party bot, v%d: https://github.com/ugjka/newyearsbot", time.Now().Year()+1)
 
 // TZ holds time zone data
 type TZ struct {
@@ -49,8 +49,14 @@ func (t TZ) String() (x string) {
 }
 
 func (t TZ) Format(max int, color bool) (x string) {
+	return t.format(max, max, color)
+}
+
+// format splits the countries into lines of max bytes, the first line has first bytes,
+// a country longer than the first line stays on it
+func (t TZ) format(first, max int, color bool) (x string) {
 	var prev int
-	var total int = max
+	var total int = first
 	for i, country := range t.Countries {
 		prev = len(x)
 		if color {
@@ -71,7 +77,7 @@ func (t TZ) Format(max int, color bool) (x string) {
 				x += ")"
 			}
 		}
-		if len(x) > total {
+		if len(x) > total && prev > 0 {
 			x = x[:prev-1] + "\n" + x[prev:]
 			total += max
 		}
@@ -182,49 +188,6 @@ func (i *Channels) Set(value string) error {
 	return nil
 }
 
-// Timer struct
-type Timer struct {
-	C      chan bool
-	Target time.Time
-	stop   chan bool
-	ticker *time.Ticker
-}
-
-// NewTimer returns a ticker based timer.
-// We need this to take into account time taken in suspend, hibernation or if system time is changed.
-func NewTimer(dur time.Duration) *Timer {
-	t := &Timer{}
-	t.C = make(chan bool)
-	t.stop = make(chan bool)
-	t.Target = now().UTC().Add(dur)
-	t.ticker = time.NewTicker(time.Millisecond * 100)
-	go func(t *Timer) {
-		defer t.ticker.Stop()
-		for range t.ticker.C {
-			select {
-			case <-t.stop:
-				return
-			default:
-				if now().UTC().After(t.Target) {
-					close(t.C)
-					return
-				}
-			}
-		}
-	}(t)
-	return t
-}
-
-// Stop stops the timer
-func (t *Timer) Stop() {
-	select {
-	case <-t.stop:
-		return
-	default:
-		close(t.stop)
-	}
-}
-
 // NominatimResult ...
 type NominatimResult struct {
 	Lat         float64
@@ -258,13 +221,35 @@ func (n *NominatimResult) UnmarshalJSON(data []byte) (err error) {
 	return
 }
 
-// cache and client for NominatimFetcher
+// cache, rate limiter and client for NominatimFetcher, shared by all the bots
 var nominatim = struct {
 	cache map[string]NominatimResults
+	// Next free request slot per nominatim server
+	next map[string]time.Time
 	sync.RWMutex
 	http.Client
 }{
 	cache: make(map[string]NominatimResults),
+	next:  make(map[string]time.Time),
+}
+
+// Nominatim's usage policy allows a request per second,
+// the limit is shared by all the bots using the server
+const nominatimInterval = time.Second
+
+// nominatimWait waits for the server's next request slot
+func nominatimWait(server string) {
+	nominatim.Lock()
+	now := time.Now()
+	slot := nominatim.next[server]
+	if slot.Before(now) {
+		slot = now
+	}
+	nominatim.next[server] = slot.Add(nominatimInterval)
+	nominatim.Unlock()
+	wait := slot.Sub(now)
+	geocoderWait.Observe(wait.Seconds())
+	time.Sleep(wait)
 }
 
 func NominatimFetcher(email, server, query string) (res NominatimResults, err error) {
@@ -273,6 +258,12 @@ func NominatimFetcher(email, server, query string) (res NominatimResults, err er
 
 // NominatimFetcher makes Nominatim API request
 func NominatimFetcherLong(email, server, country, city, query string) (res NominatimResults, err error) {
+	return fetchNominatim(&nominatim.Client, email, server, country, city, query, 1)
+}
+
+// fetchNominatim makes Nominatim API request with the client for up to limit results,
+// the cache is shared between the clients
+func fetchNominatim(client *http.Client, email, server, country, city, query string, limit int) (res NominatimResults, err error) {
 	maps := url.Values{}
 	if country != "" {
 		maps.Add("country", country)
@@ -285,21 +276,30 @@ func NominatimFetcherLong(email, server, country, city, query string) (res Nomin
 	}
 	maps.Add("format", "json")
 	maps.Add("accept-language", "en")
-	maps.Add("limit", "1")
+	maps.Add("limit", strconv.Itoa(limit))
 	maps.Add("email", email)
 	url := server + "/search?" + maps.Encode()
 	nominatim.RLock()
 	if v, ok := nominatim.cache[url]; ok {
 		nominatim.RUnlock()
+		geocoderCacheHits.Inc()
 		return v, nil
 	}
 	nominatim.RUnlock()
+	nominatimWait(server)
+	start := time.Now()
+	defer func() {
+		geocoderLatency.Observe(time.Since(start).Seconds())
+		if err != nil {
+			geocoderErrors.Inc()
+		}
+	}()
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return
 	}
 	req.Header.Set("User-Agent", userAgent)
-	resp, err := nominatim.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		return
 	}
@@ -0,0 +1,102 @@
+package nyb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Control serves the supervisor's control socket, a Unix domain socket
+// taking a command per line:
+//
+//	list          the bots and their health
+//	start <name>  start a stopped bot
+//	stop <name>   stop a bot
+//	reload        reload the configuration
+//
+// Every reply ends with a line "ok" or "error: <reason>"
+func (s *Supervisor) Control(path string) (net.Listener, error) {
+	// A stale socket of a previous run
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("control socket %s is in use", path)
+	}
+	os.Remove(path)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serveControl(conn)
+		}
+	}()
+	return ln, nil
+}
+
+func (s *Supervisor) serveControl(conn net.Conn) {
+	defer conn.Close()
+	scan := bufio.NewScanner(conn)
+	for scan.Scan() {
+		fields := strings.Fields(scan.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if err := s.command(conn, fields[0], fields[1:]); err != nil {
+			fmt.Fprintf(conn, "error: %v\n", err)
+			continue
+		}
+		fmt.Fprintln(conn, "ok")
+	}
+}
+
+func (s *Supervisor) command(w io.Writer, cmd string, args []string) error {
+	name := strings.Join(args, " ")
+	switch cmd {
+	case "list":
+		for _, h := range s.List() {
+			fmt.Fprintln(w, h)
+		}
+		return nil
+	case "start":
+		return s.Start(name)
+	case "stop":
+		return s.Stop(name)
+	case "reload":
+		return s.Reload()
+	}
+	return fmt.Errorf("unknown command: %s", cmd)
+}
+
+// String formats the health for the control socket
+func (h Health) String() string {
+	state := "stopped"
+	if h.Running {
+		state = "running"
+	}
+	conn := "disconnected"
+	if h.Connected {
+		conn = "connected"
+	}
+	s := fmt.Sprintf("%s %s %s server=%s nick=%s restarts=%d panics=%d", h.Name, state, conn,
+		h.Server, h.Nick, h.Restarts, h.Panics)
+	if h.Running {
+		s += " uptime=" + time.Since(h.Started).Round(time.Second).String()
+	}
+	if h.LastPanic != "" {
+		s += fmt.Sprintf(" last-panic=%q", h.LastPanic)
+	}
+	return s
+}
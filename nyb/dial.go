@@ -0,0 +1,127 @@
+package nyb
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+const dialTimeout = time.Second * 30
+
+// dial connects to the irc server.
+// TLS is done here instead of kittybot so that the connection can be wrapped
+func (bot *Settings) dial(network, addr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if bot.Proxy != "" {
+		conn, err = proxyDial(bot.Proxy, addr)
+	} else {
+		conn, err = net.DialTimeout(network, addr, dialTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if bot.SSL {
+		config, err := bot.tlsConfig(addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tconn := tls.Client(conn, config)
+		tconn.SetDeadline(time.Now().Add(dialTimeout))
+		if err := tconn.Handshake(); err != nil {
+			conn.Close()
+			return nil, tlsError(err, config.ServerName)
+		}
+		tconn.SetDeadline(time.Time{})
+		conn = tconn
+	}
+	bot.v3.reset()
+	bot.connMu.Lock()
+	defer bot.connMu.Unlock()
+	if bot.stopped() {
+		conn.Close()
+		return nil, errStopped
+	}
+	bot.conn = conn
+	return &ircConn{Conn: conn, bot: bot, addr: addr}, nil
+}
+
+// CheckConnection connects to the server with the proxy and TLS settings and disconnects
+func (bot *Settings) CheckConnection() error {
+	conn, err := bot.dial("tcp", bot.Server)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (bot *Settings) tlsConfig(addr string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		ServerName: host,
+	}
+	if err := bot.TLS.apply(config); err != nil {
+		return nil, err
+	}
+	if bot.Auth.Cert != "" {
+		cert, err := bot.Auth.certificate()
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// ircConn intercepts the lines kittybot sends and receives,
+// kittybot writes a single line per Write
+type ircConn struct {
+	net.Conn
+	bot  *Settings
+	addr string
+	buf  [4096]byte
+	// Incomplete line from the server
+	in []byte
+	// Lines for kittybot
+	out []byte
+	err error
+}
+
+func (c *ircConn) Write(p []byte) (int, error) {
+	line := c.bot.saslRewrite(p)
+	line = c.bot.capLS(line)
+	line = c.bot.capReq(line)
+	if _, err := c.Conn.Write(line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *ircConn) Read(p []byte) (int, error) {
+	for len(c.out) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		n, err := c.Conn.Read(c.buf[:])
+		c.in = append(c.in, c.buf[:n]...)
+		for {
+			i := bytes.IndexByte(c.in, '\n')
+			if i < 0 {
+				break
+			}
+			if line := c.bot.incoming(c.addr, c.in[:i+1]); line != nil {
+				c.out = append(c.out, line...)
+			}
+			c.in = c.in[i+1:]
+		}
+		c.err = err
+	}
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
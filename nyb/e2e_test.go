@@ -0,0 +1,416 @@
+package nyb_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ugjka/newyearsbot/metrics"
+	"github.com/ugjka/newyearsbot/nyb"
+	"github.com/ugjka/newyearsbot/nyb/clock/clocktest"
+	"github.com/ugjka/newyearsbot/nyb/irctest"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+const timeout = time.Second * 10
+
+type e2e struct {
+	t     *testing.T
+	srv   *irctest.Server
+	clock *clocktest.Fake
+	nick  string
+}
+
+func newServer(t *testing.T) *irctest.Server {
+	srv, err := irctest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// startBot starts a bot on the fake irc server with a fake clock
+// and waits for it to join #test
+func startBot(t *testing.T, srv *irctest.Server, nick string, start time.Time, opts ...func(*nyb.Settings)) *e2e {
+	geo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("q") {
+		case "riga":
+			fmt.Fprint(w, `[{"lat":"56.9496","lon":"24.1052","display_name":"Riga, Latvia"},`+
+				`{"lat":"56.95","lon":"24.11","display_name":"Riga, Vidzeme, Latvia"}]`)
+		case "paris":
+			fmt.Fprint(w, `[{"lat":"48.8566","lon":"2.3522","display_name":"Paris, Ile-de-France, Metropolitan France, France"},`+
+				`{"lat":"33.6609","lon":"-95.5555","display_name":"Paris, Lamar County, Texas, United States"}]`)
+		default:
+			fmt.Fprint(w, `[]`)
+		}
+	}))
+	t.Cleanup(geo.Close)
+	clk := clocktest.New(start)
+	settings := &nyb.Settings{
+		Nick:      nick,
+		Channels:  []string{"#test"},
+		Server:    srv.Addr(),
+		Prefix:    "!",
+		Email:     "test@example.com",
+		Nominatim: geo.URL,
+		Clock:     clk,
+		RealClock: clk,
+	}
+	for _, opt := range opts {
+		opt(settings)
+	}
+	bot := nyb.New(settings)
+	bot.LogLvl(log.LvlCrit)
+	go bot.Start()
+	if err := srv.WaitJoin(timeout, nick, "#test"); err != nil {
+		t.Fatal("bot didn't join:", err)
+	}
+	return &e2e{t: t, srv: srv, clock: clk, nick: nick}
+}
+
+// expect asserts the next message the bot sends to target
+func (e *e2e) expect(target, text string) {
+	e.t.Helper()
+	got, err := e.srv.ExpectMsg(timeout, e.nick, target)
+	if err != nil {
+		e.t.Fatalf("expected %q: %v", text, err)
+	}
+	if got != text {
+		e.t.Errorf("expected %q; got %q", text, got)
+	}
+}
+
+// command sends a command to #test and asserts the reply
+func (e *e2e) command(cmd, reply string) {
+	e.t.Helper()
+	e.srv.Privmsg("user", "#test", cmd)
+	e.expect("#test", reply)
+}
+
+const kiribati = "Kiribati (Kiritimati, Line Islands)"
+
+// helpText is the help of a bot with all the commands
+const helpText = "Commands: '!hny [location]', '!time [location]', '!zone <offset>', '!where <country>', '!schedule [location]', " +
+	"'!countdown [location]', '!setlocation <place>', '!notifyme [off]', '!forgetme', '!next', '!previous', '!remaining', " +
+	"'!help [command]', '!source'"
+
+// A minute before the first new year
+var eve = time.Date(2024, time.December, 31, 9, 59, 0, 0, time.UTC)
+
+func TestE2EAnnouncements(t *testing.T) {
+	t.Parallel()
+	e := startBot(t, newServer(t), "e2ebot", eve)
+
+	e.expect("#test", "First New Year in 53 seconds in "+kiribati)
+	e.expect("#test", helpText)
+
+	e.clock.Advance(time.Minute)
+	e.expect("#test", "Happy New Year in "+kiribati)
+	e.expect("#test", "Next New Year in 14 minutes 51 seconds. See !next or !help.")
+}
+
+func TestE2ECommands(t *testing.T) {
+	t.Parallel()
+	e := startBot(t, newServer(t), "e2ecmd", eve)
+	e.expect("#test", "First New Year in 53 seconds in "+kiribati)
+	e.expect("#test", helpText)
+
+	e.command("!next", "Next New Year in 53 seconds in "+kiribati)
+	e.command("!time", "Time is Tue Dec 31 09:59:07 +0000 UTC 2024")
+	e.command("!source", "https://github.com/ugjka/newyearsbot")
+	e.command("!hny riga", "New Year in Riga, Latvia will happen in 12 hours 53 seconds")
+	e.command("!hny nowhere", "couldn't find that place")
+	e.command("!time riga", "Time in Riga, Latvia is Tue Dec 31 11:59:07 +0200 EET 2024")
+	// Answered without the geocoder
+	e.command("!hny Europe/Riga", "New Year in Europe/Riga will happen in 12 hours 53 seconds")
+	e.command("!time america/port_of_spain", "Time in America/Port_of_Spain is Tue Dec 31 05:59:07 -0400 AST 2024")
+	e.command("!hny UTC+5:45", "New Year in UTC+5:45 will happen in 8 hours 15 minutes")
+	e.command("!hny gmt-3", "New Year in UTC-3 will happen in 17 hours 53 seconds")
+	e.command("!time 56.95,24.1", "Time in 56.95, 24.1 (Europe/Riga) is Tue Dec 31 11:59:07 +0200 EET 2024")
+	e.command("!hny 91,0", "couldn't find that place")
+	e.command("!zone +5:45", "New Year at UTC+5:45 will happen in 8 hours 15 minutes in Nepal (Biratnagar, Kathmandu, Pokhara)")
+	e.command("!zone 9:30", "New Year at UTC+9:30 will happen in 4 hours 30 minutes in "+
+		"Australia (Alice Springs, Darwin, Northern Territory)")
+	e.command("!zone utc+3:15", "No one celebrates at UTC+3:15")
+	e.command("!zone soon", "Usage: !zone <offset>, e.g. !zone +9:30")
+	e.command("!where latvia", "New Year in Latvia: UTC+2 in 12 hours 53 seconds")
+	e.command("!where atlantis", "couldn't find that country")
+	e.command("!where united", "Which one? United Arab Emirates, United Kingdom, United States")
+	e.command("!hny paris", "Which one? 1) Paris, France (Europe/Paris) 2) Paris, United States (America/Chicago). "+
+		"Pick with !hny <number> or !time <number>")
+	e.command("!hny 2", "New Year in Paris, Lamar County, Texas, United States will happen in 20 hours 53 seconds")
+	e.command("!time 1", "Time in Paris, Ile-de-France, Metropolitan France, France is Tue Dec 31 10:59:07 +0100 CET 2024")
+	// Only for the user who asked
+	e.srv.Privmsg("other", "#test", "!hny 2")
+	e.expect("#test", "couldn't find that place")
+	e.command("!help", helpText)
+
+	// Private commands are answered privately
+	e.srv.Privmsg("user", e.nick, "!source")
+	e.expect("user", "https://github.com/ugjka/newyearsbot")
+
+	// Notices are not commands
+	e.srv.Notice("user", "#test", "!source")
+	e.clock.Advance(time.Minute)
+	e.expect("#test", "Happy New Year in "+kiribati)
+	e.expect("#test", "Next New Year in 14 minutes 51 seconds. See !next or !help.")
+	e.command("!remaining", "37 timezones remaining. 2.63% are in the new year")
+	e.command("!previous", "Previous New Year was 9 seconds ago in "+kiribati)
+	e.command("!zone +14", "New Year at UTC+14 happened 9 seconds ago in "+kiribati)
+	e.command("!where KIRIBATI", "New Year in Kiribati: UTC+14 9 seconds ago, UTC+13 in 59 minutes 51 seconds, "+
+		"UTC+12 in 1 hour 59 minutes")
+}
+
+func TestE2EFloodProtection(t *testing.T) {
+	t.Parallel()
+	// Threaded replies are sent with message tags
+	for _, tc := range []struct {
+		nick        string
+		limit, tags bool
+	}{
+		{"e2efloodlimit", true, false},
+		{"e2efloodnolimit", false, false},
+		{"e2efloodtags", true, true},
+		{"e2efloodtagsno", false, true},
+	} {
+		floodTest(t, tc.nick, tc.limit, tc.tags)
+	}
+}
+
+func floodTest(t *testing.T, nick string, limit, tags bool) {
+	srv := newServer(t)
+	if tags {
+		srv.Caps = []string{"message-tags"}
+	}
+	e := startBot(t, srv, nick, eve,
+		func(s *nyb.Settings) {
+			s.Limit = limit
+		})
+	e.expect("#test", "First New Year in 53 seconds in "+kiribati)
+	e.srv.FloodLimit = 8
+	for i := 0; i < 12; i++ {
+		e.srv.Privmsg("spammer", "#test", "!source")
+	}
+	kicked := func() bool {
+		for _, k := range e.srv.Kicks() {
+			if strings.HasSuffix(k, " "+e.nick) {
+				return true
+			}
+		}
+		return false
+	}
+	deadline := time.Now().Add(time.Second * 4)
+	for time.Now().Before(deadline) && !kicked() {
+		time.Sleep(time.Millisecond * 100)
+	}
+	if limit && kicked() {
+		t.Error("rate limited bot was flood kicked")
+	}
+	if !limit && !kicked() {
+		t.Error("unlimited bot was not flood kicked")
+	}
+}
+
+func TestE2EAuth(t *testing.T) {
+	t.Parallel()
+	tt := []struct {
+		name     string
+		auth     nyb.Auth
+		account  string
+		identify string
+	}{
+		{
+			name:    "sasl",
+			auth:    nyb.Auth{Mode: nyb.AuthSASL, User: "partyacct", Password: "secret"},
+			account: "partyacct",
+		},
+		{
+			name:     "fallback",
+			auth:     nyb.Auth{Mode: nyb.AuthSASL, User: "partyacct", Password: "wrong", NickServ: true},
+			identify: "IDENTIFY partyacct wrong",
+		},
+		{
+			name:     "nickserv",
+			auth:     nyb.Auth{Mode: nyb.AuthNickServ, Password: "secret"},
+			identify: "IDENTIFY e2enickserv secret",
+		},
+	}
+	for _, tc := range tt {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			srv := newServer(t)
+			srv.SASL = true
+			srv.Accounts = map[string]string{"partyacct": "secret"}
+			nick := "e2e" + tc.name
+			startBot(t, srv, nick, eve, func(s *nyb.Settings) {
+				s.Auth = tc.auth
+			})
+			if got := srv.Account(nick); got != tc.account {
+				t.Errorf("expected account %q; got %q", tc.account, got)
+			}
+			if tc.identify == "" {
+				return
+			}
+			got, err := srv.ExpectMsg(timeout, nick, "NickServ")
+			if err != nil {
+				t.Fatal("no nickserv identify:", err)
+			}
+			if got != tc.identify {
+				t.Errorf("expected %q; got %q", tc.identify, got)
+			}
+		})
+	}
+}
+
+// selfSigned returns a throwaway self-signed certificate for name
+func selfSigned(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestE2EAuthExternal(t *testing.T) {
+	t.Parallel()
+	srv, err := irctest.NewTLSServer(&tls.Config{
+		Certificates: []tls.Certificate{selfSigned(t, "irc.test")},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+	srv.SASL = true
+
+	// The certificate and its key in one file
+	client := selfSigned(t, "e2eexternal")
+	key, err := x509.MarshalPKCS8PrivateKey(client.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "client.pem")
+	data := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: client.Certificate[0]}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})...)
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	startBot(t, srv, "e2eexternal", eve, func(s *nyb.Settings) {
+		s.SSL = true
+		s.TLS = nyb.TLS{Insecure: true}
+		s.Auth = nyb.Auth{Mode: nyb.AuthExternal, Cert: file}
+	})
+	cert := srv.ClientCert("e2eexternal")
+	if cert == nil || !bytes.Equal(cert.Raw, client.Certificate[0]) {
+		t.Error("the server didn't see the client certificate")
+	}
+	if got := srv.Account("e2eexternal"); got != "certfp" {
+		t.Errorf("expected account %q; got %q", "certfp", got)
+	}
+}
+
+func TestE2ESchedule(t *testing.T) {
+	t.Parallel()
+	e := startBot(t, newServer(t), "e2esched", eve)
+	e.expect("#test", "First New Year in 53 seconds in "+kiribati)
+	e.expect("#test", helpText)
+
+	// Sent privately
+	e.srv.Privmsg("user", "#test", "!schedule riga")
+	e.expect("user", "New Year 2025 schedule for Riga, Latvia")
+	e.expect("user", "Dec 31 10:00 UTC (Dec 31 12:00 your time) UTC+14: "+kiribati)
+	e.expect("user", "Dec 31 10:15 UTC (Dec 31 12:15 your time) UTC+13:45: New Zealand (Chatham Islands)")
+	e.expect("user", "Dec 31 11:00 UTC (Dec 31 13:00 your time) UTC+13: "+samoa)
+	e.expect("user", "Page 1/10, !schedule more for the next page")
+	e.command("!schedule more", "Wait 10 seconds for the next schedule page")
+
+	e.clock.Advance(time.Second * 10)
+	e.srv.Privmsg("user", "#test", "!schedule more")
+	e.expect("user", "Dec 31 12:00 UTC (Dec 31 14:00 your time) UTC+12: Fiji (Suva), France (Wallis and Futuna), "+
+		"Kiribati (Gilbert Islands, Tarawa), Marshall Islands (Majuro), Nauru (Yaren), Norfolk Island (Kingston), "+
+		"Russia (Anadyr, Petropavlovsk-Kamchatsky, Pevek), Tuvalu (Funafuti), United States (Wake Island)")
+	e.clock.Advance(time.Second * 10)
+	e.command("!schedule nowhere", "couldn't find that place")
+}
+
+func TestE2ERouter(t *testing.T) {
+	t.Parallel()
+	e := startBot(t, newServer(t), "e2erouter", eve, func(s *nyb.Settings) {
+		s.Commands = nyb.Commands{
+			Aliases:  map[string][]string{"hny": {"ny"}},
+			Disabled: map[string][]string{"#TEST": {"schedule"}},
+		}
+	})
+	help := strings.Replace(helpText, "'!schedule [location]', ", "", 1)
+	e.expect("#test", "First New Year in 53 seconds in "+kiribati)
+	e.expect("#test", help)
+
+	e.command("!ny riga", "New Year in Riga, Latvia will happen in 12 hours 53 seconds")
+	e.command("!HNY riga", "New Year in Riga, Latvia will happen in 12 hours 53 seconds")
+	// Exact names only
+	e.srv.Privmsg("user", "#test", "!nextfoo")
+	e.srv.Privmsg("user", "#test", "!previously")
+	e.command("!prev", "Previous New Year was 52 weeks 21 hours ago in United States (Baker Island, Howland Island)")
+	e.command("!next now", "Usage: !next")
+	e.command("!zone", "Usage: !zone <offset>, e.g. !zone +9:30")
+	e.command("!help", help)
+	e.command("!help hny", "!hny [location]: when New Year happens in a location or at your saved location, e.g. !hny Riga, also !ny")
+	e.command("!help !prev", "!previous: the previous New Year, also !prev")
+	e.command("!help party", "No such command: party, see !help")
+	e.command("!help hny extra", "!hny [location]: when New Year happens in a location or at your saved location, e.g. !hny Riga, also !ny")
+	// Disabled in the channel only
+	e.command("!help schedule", "No such command: schedule, see !help")
+	e.srv.Privmsg("user", e.nick, "!schedule")
+	e.expect("user", "New Year 2025 schedule")
+	// Would be told to wait for the next page
+	e.srv.Privmsg("user", "#test", "!schedule")
+	e.command("!source", "https://github.com/ugjka/newyearsbot")
+}
+
+func TestE2EMetricsChannelKey(t *testing.T) {
+	t.Parallel()
+	e := startBot(t, newServer(t), "e2ekeyed", eve, func(s *nyb.Settings) {
+		s.Channels = []string{"#test:hunter2"}
+	})
+	e.expect("#test", "First New Year in 53 seconds in "+kiribati)
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	if !strings.Contains(body, `nyb_messages_sent_total{server="`+e.srv.Addr()+`",channel="#test"}`) {
+		t.Errorf("no message count for #test:\n%s", body)
+	}
+	if strings.Contains(body, "hunter2") {
+		t.Error("channel key in the metrics")
+	}
+}
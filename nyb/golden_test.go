@@ -0,0 +1,82 @@
+package nyb
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ugjka/newyearsbot/audit"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// escapes irc formatting so that the golden files stay readable
+var goldenEscape = strings.NewReplacer("\x02", `\x02`, "\x03", `\x03`, "\x0f", `\x0f`)
+
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.MkdirAll("testdata", 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	expected, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v, run the tests with -update to create it", err)
+	}
+	if !bytes.Equal(expected, got) {
+		t.Errorf("%s differs from the golden file, run the tests with -update and review the diff", path)
+	}
+}
+
+func goldenZones(t *testing.T) TZS {
+	bot := &Settings{}
+	if err := bot.decodeZones(Zones); err != nil {
+		t.Fatal(err)
+	}
+	return bot.zones
+}
+
+// TestGoldenAnnouncements renders the "Happy New Year" announcement of every zone
+// the way loopTimeZones does, each line is prefixed with its length in bytes
+func TestGoldenAnnouncements(t *testing.T) {
+	zones := goldenZones(t)
+	for _, colors := range []bool{false, true} {
+		for _, maxSize := range []int{150, 250, 400} {
+			name := fmt.Sprintf("announce_%d", maxSize)
+			if colors {
+				name += "_color"
+			}
+			t.Run(name, func(t *testing.T) {
+				bot := &Settings{Colors: colors}
+				happy := bot.col("Happy New Year") + " in "
+				var buf bytes.Buffer
+				for _, zone := range zones {
+					fmt.Fprintf(&buf, "# %s\n", audit.OffsetName(zone.Offset))
+					text := happy + zone.Format(maxSize-len(happy), colors)
+					for _, line := range strings.Split(text, "\n") {
+						fmt.Fprintf(&buf, "[%3d] %s\n", len(line), goldenEscape.Replace(line))
+					}
+				}
+				golden(t, name, buf.Bytes())
+			})
+		}
+	}
+}
+
+func TestGoldenString(t *testing.T) {
+	var buf bytes.Buffer
+	for _, zone := range goldenZones(t) {
+		fmt.Fprintf(&buf, "# %s\n%s\n", audit.OffsetName(zone.Offset), zone.String())
+	}
+	golden(t, "zones", buf.Bytes())
+}
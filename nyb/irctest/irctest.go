@@ -0,0 +1,686 @@
+// Package irctest is a minimal in-process IRC server for testing the bot
+package irctest
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Line is a line received from a client
+type Line struct {
+	// Nick of the sending client
+	Nick    string
+	Tags    map[string]string
+	Command string
+	Params  []string
+	Raw     string
+}
+
+// Param returns the i-th parameter or an empty string
+func (l Line) Param(i int) string {
+	if i < len(l.Params) {
+		return l.Params[i]
+	}
+	return ""
+}
+
+// Server is a fake IRC server
+type Server struct {
+	// Server name used as the prefix of server messages
+	Name string
+	// Tokens sent in RPL_ISUPPORT
+	ISupport []string
+	// Kick clients that send more than FloodLimit
+	// PRIVMSGs or NOTICEs within FloodWindow, 0 disables the flood kick
+	FloodLimit  int
+	FloodWindow time.Duration
+	// Offer SASL, PLAIN logins are checked against Accounts,
+	// EXTERNAL logins succeed as the account "certfp" when the client presented a TLS certificate
+	SASL     bool
+	Accounts map[string]string
+	// Accounts of the fake users by nick, sent in account tags
+	Logins map[string]string
+	// Extra IRCv3 capabilities to offer, values are shown to CAP LS 302 clients,
+	// e.g. "echo-message" or "draft/multiline=max-bytes=4096,max-lines=24"
+	Caps []string
+	// Clock for the server-time tags, defaults to time.Now
+	Now func() time.Time
+
+	ln       net.Listener
+	mu       sync.Mutex
+	cond     *sync.Cond
+	clients  map[*client]bool
+	channels map[string]map[*client]bool
+	lines    []Line
+	cursor   int
+	kicks    []string
+	closed   bool
+	seq      int
+	conns    int
+	hold     bool
+}
+
+type client struct {
+	conn       net.Conn
+	nick       string
+	user       string
+	registered bool
+	capping    bool
+	sasl       string
+	account    string
+	sent       []time.Time
+	caps       map[string]bool
+	batches    map[string]*batch
+	wmu        sync.Mutex
+}
+
+// batch is a draft/multiline batch being sent by a client
+type batch struct {
+	target string
+	tags   map[string]string
+	lines  []string
+}
+
+// NewServer starts a server listening on a random local port
+func NewServer() (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	return newServer(ln), nil
+}
+
+// NewTLSServer starts a TLS server listening on a random local port
+func NewTLSServer(config *tls.Config) (*Server, error) {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		return nil, err
+	}
+	return newServer(ln), nil
+}
+
+func newServer(ln net.Listener) *Server {
+	s := &Server{
+		Name:        "irc.test",
+		ISupport:    []string{"CHANTYPES=#&", "NICKLEN=30", "CHANNELLEN=64", "NETWORK=TestNet"},
+		FloodWindow: time.Second * 10,
+		ln:          ln,
+		clients:     make(map[*client]bool),
+		channels:    make(map[string]map[*client]bool),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	go s.accept()
+	return s
+}
+
+// Addr returns the server's host:port
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops the server and disconnects all the clients
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+	for c := range s.clients {
+		c.conn.Close()
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	s.ln.Close()
+}
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &client{
+			conn:    conn,
+			caps:    make(map[string]bool),
+			batches: make(map[string]*batch),
+		}
+		s.mu.Lock()
+		s.clients[c] = true
+		s.conns++
+		s.mu.Unlock()
+		go s.serve(c)
+	}
+}
+
+func (s *Server) serve(c *client) {
+	defer s.disconnect(c)
+	scan := bufio.NewScanner(c.conn)
+	for scan.Scan() {
+		line := parse(scan.Text())
+		s.mu.Lock()
+		line.Nick = c.nick
+		s.lines = append(s.lines, line)
+		s.cond.Broadcast()
+		s.handle(c, line)
+		s.mu.Unlock()
+	}
+}
+
+func (s *Server) disconnect(c *client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.conn.Close()
+	delete(s.clients, c)
+	for _, members := range s.channels {
+		delete(members, c)
+	}
+}
+
+// handle is called with the lock held
+func (s *Server) handle(c *client, l Line) {
+	switch l.Command {
+	case "CAP":
+		switch l.Param(0) {
+		case "LS":
+			c.capping = true
+			s.capLS(c, l.Param(1) == "302")
+		case "REQ":
+			s.capReq(c, l.Param(1))
+		case "END":
+			c.capping = false
+			s.register(c)
+		}
+	case "AUTHENTICATE":
+		s.authenticate(c, l.Param(0))
+	case "PASS":
+	case "NICK":
+		c.nick = l.Param(0)
+		s.register(c)
+	case "USER":
+		c.user = l.Param(0)
+		s.register(c)
+	case "PING":
+		s.send(c, ":%s PONG %s :%s", s.Name, s.Name, l.Param(0))
+	case "JOIN":
+		for _, ch := range strings.Split(l.Param(0), ",") {
+			s.join(c, ch)
+		}
+	case "PART":
+		ch := strings.ToLower(l.Param(0))
+		s.broadcast(ch, ":%s PART %s", c.prefix(), l.Param(0))
+		delete(s.channels[ch], c)
+	case "PRIVMSG", "NOTICE":
+		s.message(c, l)
+	case "BATCH":
+		s.batch(c, l)
+	case "QUIT":
+		c.conn.Close()
+	}
+}
+
+func (s *Server) caps() []string {
+	var caps []string
+	if s.SASL {
+		caps = append(caps, "sasl=PLAIN,EXTERNAL")
+	}
+	return append(caps, s.Caps...)
+}
+
+// capLS lists the capabilities, CAP LS 302 gets the values over two lines
+func (s *Server) capLS(c *client, v302 bool) {
+	var caps []string
+	for _, cap := range s.caps() {
+		if !v302 {
+			cap = strings.SplitN(cap, "=", 2)[0]
+		}
+		caps = append(caps, cap)
+	}
+	if v302 && len(caps) > 2 {
+		half := len(caps) / 2
+		s.send(c, ":%s CAP * LS * :%s", s.Name, strings.Join(caps[:half], " "))
+		caps = caps[half:]
+	}
+	s.send(c, ":%s CAP * LS :%s", s.Name, strings.Join(caps, " "))
+}
+
+// capReq acknowledges the request if all the capabilities are offered
+func (s *Server) capReq(c *client, req string) {
+	offered := make(map[string]bool)
+	for _, cap := range s.caps() {
+		offered[strings.SplitN(cap, "=", 2)[0]] = true
+	}
+	for _, cap := range strings.Fields(req) {
+		if !offered[cap] {
+			s.send(c, ":%s CAP * NAK :%s", s.Name, req)
+			return
+		}
+	}
+	for _, cap := range strings.Fields(req) {
+		c.caps[cap] = true
+	}
+	s.send(c, ":%s CAP * ACK :%s", s.Name, req)
+}
+
+func (s *Server) authenticate(c *client, arg string) {
+	nick := c.nick
+	if nick == "" {
+		nick = "*"
+	}
+	switch {
+	case arg == "PLAIN" || arg == "EXTERNAL":
+		c.sasl = arg
+		s.send(c, "AUTHENTICATE +")
+		return
+	case c.sasl == "EXTERNAL" && arg == "+":
+		if clientCert(c) != nil {
+			c.account = "certfp"
+		}
+	case c.sasl == "PLAIN":
+		data, err := base64.StdEncoding.DecodeString(arg)
+		parts := strings.Split(string(data), "\x00")
+		if err == nil && len(parts) == 3 && s.Accounts[parts[1]] != "" &&
+			s.Accounts[parts[1]] == parts[2] {
+			c.account = parts[1]
+		}
+	}
+	c.sasl = ""
+	if c.account == "" {
+		s.send(c, ":%s 904 %s :SASL authentication failed", s.Name, nick)
+		return
+	}
+	s.send(c, ":%s 900 %s %s %s :You are now logged in as %s", s.Name, nick, c.prefix(), c.account, c.account)
+	s.send(c, ":%s 903 %s :SASL authentication successful", s.Name, nick)
+}
+
+// Account returns the account nick is logged in as
+func (s *Server) Account(nick string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		if c.nick == nick {
+			return c.account
+		}
+	}
+	return ""
+}
+
+// ClientCert returns the TLS certificate nick presented, nil without one
+func (s *Server) ClientCert(nick string) *x509.Certificate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		if c.nick == nick {
+			return clientCert(c)
+		}
+	}
+	return nil
+}
+
+func clientCert(c *client) *x509.Certificate {
+	conn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	return certs[0]
+}
+
+func (s *Server) register(c *client) {
+	if s.hold || c.registered || c.capping || c.nick == "" || c.user == "" {
+		return
+	}
+	c.registered = true
+	s.send(c, ":%s 001 %s :Welcome to the test network %s", s.Name, c.nick, c.prefix())
+	s.send(c, ":%s 005 %s %s :are supported by this server", s.Name, c.nick, strings.Join(s.ISupport, " "))
+	s.send(c, ":%s 422 %s :MOTD File is missing", s.Name, c.nick)
+}
+
+func (s *Server) join(c *client, ch string) {
+	name := strings.ToLower(ch)
+	if s.channels[name] == nil {
+		s.channels[name] = make(map[*client]bool)
+	}
+	s.channels[name][c] = true
+	s.broadcast(name, ":%s JOIN %s", c.prefix(), ch)
+	s.send(c, ":%s 353 %s = %s :%s", s.Name, c.nick, ch, c.nick)
+	s.send(c, ":%s 366 %s %s :End of /NAMES list", s.Name, c.nick, ch)
+}
+
+func (s *Server) message(c *client, l Line) {
+	target := l.Param(0)
+	text := l.Param(1)
+	if s.FloodLimit > 0 {
+		now := time.Now()
+		var recent []time.Time
+		for _, t := range c.sent {
+			if now.Sub(t) < s.FloodWindow {
+				recent = append(recent, t)
+			}
+		}
+		c.sent = append(recent, now)
+		if len(c.sent) > s.FloodLimit {
+			for name, members := range s.channels {
+				if members[c] {
+					s.broadcast(name, ":%s KICK %s %s :Excess flood", s.Name, name, c.nick)
+					delete(members, c)
+					s.kicks = append(s.kicks, name+" "+c.nick)
+				}
+			}
+			return
+		}
+	}
+	if ref := l.Tags["batch"]; ref != "" {
+		if b := c.batches[ref]; b != nil {
+			b.lines = append(b.lines, text)
+			return
+		}
+	}
+	s.deliver(c.prefix(), l.Command, target, []string{text}, c, l.Tags)
+}
+
+// batch collects a draft/multiline batch and delivers it at the end
+func (s *Server) batch(c *client, l Line) {
+	ref := l.Param(0)
+	switch {
+	case strings.HasPrefix(ref, "+"):
+		c.batches[ref[1:]] = &batch{target: l.Param(2), tags: l.Tags}
+	case strings.HasPrefix(ref, "-"):
+		b := c.batches[ref[1:]]
+		delete(c.batches, ref[1:])
+		if b != nil {
+			s.deliver(c.prefix(), "PRIVMSG", b.target, b.lines, c, b.tags)
+		}
+	}
+}
+
+// deliver is called with the lock held,
+// several lines are delivered as a draft/multiline batch
+func (s *Server) deliver(prefix, command, target string, lines []string, from *client, tags map[string]string) string {
+	s.seq++
+	msgid := fmt.Sprintf("msg%d", s.seq)
+	var recipients []*client
+	if members, ok := s.channels[strings.ToLower(target)]; ok {
+		for m := range members {
+			if m != from {
+				recipients = append(recipients, m)
+			}
+		}
+	} else {
+		for c := range s.clients {
+			if strings.EqualFold(c.nick, target) {
+				recipients = append(recipients, c)
+			}
+		}
+	}
+	account := s.Logins[strings.SplitN(prefix, "!", 2)[0]]
+	if from != nil {
+		account = from.account
+	}
+	for _, m := range recipients {
+		s.deliverTo(m, prefix, command, target, lines, s.tags(m, msgid, tags, "", account))
+	}
+	if from == nil {
+		return msgid
+	}
+	label := tags["label"]
+	if from.caps["echo-message"] {
+		s.deliverTo(from, prefix, command, target, lines, s.tags(from, msgid, tags, label, account))
+	} else if label != "" && from.caps["labeled-response"] {
+		s.send(from, "@label=%s :%s ACK", label, s.Name)
+	}
+	return msgid
+}
+
+func (s *Server) deliverTo(c *client, prefix, command, target string, lines []string, tags string) {
+	if len(lines) == 1 || !c.caps["draft/multiline"] {
+		for i, line := range lines {
+			if i > 0 {
+				tags = ""
+			}
+			s.send(c, "%s:%s %s %s :%s", tags, prefix, command, target, line)
+		}
+		return
+	}
+	s.seq++
+	ref := fmt.Sprintf("batch%d", s.seq)
+	s.send(c, "%s:%s BATCH +%s draft/multiline %s", tags, prefix, ref, target)
+	for _, line := range lines {
+		s.send(c, "@batch=%s :%s %s %s :%s", ref, prefix, command, target, line)
+	}
+	s.send(c, ":%s BATCH -%s", prefix, ref)
+}
+
+// tags returns the message tags for the recipient
+func (s *Server) tags(c *client, msgid string, client map[string]string, label, account string) string {
+	var tags []string
+	if account != "" && c.caps["account-tag"] {
+		tags = append(tags, "account="+tagEscaper.Replace(account))
+	}
+	if label != "" && c.caps["labeled-response"] {
+		tags = append(tags, "label="+label)
+	}
+	if c.caps["server-time"] {
+		now := time.Now
+		if s.Now != nil {
+			now = s.Now
+		}
+		tags = append(tags, "time="+now().UTC().Format("2006-01-02T15:04:05.000Z"))
+	}
+	if c.caps["message-tags"] {
+		tags = append(tags, "msgid="+msgid)
+		var keys []string
+		for k := range client {
+			if strings.HasPrefix(k, "+") {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			tags = append(tags, k+"="+tagEscaper.Replace(client[k]))
+		}
+	}
+	if len(tags) == 0 {
+		return ""
+	}
+	return "@" + strings.Join(tags, ";") + " "
+}
+
+var (
+	tagEscaper   = strings.NewReplacer(`\`, `\\`, ";", `\:`, " ", `\s`, "\r", `\r`, "\n", `\n`)
+	tagUnescaper = strings.NewReplacer(`\\`, `\`, `\:`, ";", `\s`, " ", `\r`, "\r", `\n`, "\n")
+)
+
+func (s *Server) broadcast(ch, format string, args ...interface{}) {
+	for m := range s.channels[strings.ToLower(ch)] {
+		s.send(m, format, args...)
+	}
+}
+
+func (s *Server) send(c *client, format string, args ...interface{}) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+	fmt.Fprintf(c.conn, format+"\r\n", args...)
+}
+
+func (c *client) prefix() string {
+	return fmt.Sprintf("%s!%s@test.user", c.nick, c.user)
+}
+
+// Privmsg sends a PRIVMSG from a fake user to a channel or a connected client
+// and returns its msgid
+func (s *Server) Privmsg(from, target, text string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deliver(from+"!"+from+"@fake.user", "PRIVMSG", target, []string{text}, nil, nil)
+}
+
+// Notice sends a NOTICE from a fake user to a channel or a connected client
+func (s *Server) Notice(from, target, text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deliver(from+"!"+from+"@fake.user", "NOTICE", target, []string{text}, nil, nil)
+}
+
+// Hold stops registering new clients until it is called with false,
+// the held clients are registered then
+func (s *Server) Hold(hold bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hold = hold
+	if hold {
+		return
+	}
+	for c := range s.clients {
+		s.register(c)
+	}
+}
+
+// Connections returns the number of connections accepted so far
+func (s *Server) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+// Disconnect closes the connection of nick
+func (s *Server) Disconnect(nick string) {
+	s.Ban(nick, "")
+}
+
+// Ban K-lines nick with the reason and closes its connection
+func (s *Server) Ban(nick, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		if c.nick != nick {
+			continue
+		}
+		if reason != "" {
+			s.send(c, ":%s 465 %s :You are banned from this server- %s", s.Name, nick, reason)
+			s.send(c, "ERROR :Closing Link: test.user (K-Lined)")
+		}
+		c.conn.Close()
+	}
+}
+
+// Kicks returns the flood kicks as "#channel nick"
+func (s *Server) Kicks() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.kicks...)
+}
+
+// Lines returns all the lines received so far
+func (s *Server) Lines() []Line {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Line{}, s.lines...)
+}
+
+// ErrTimeout is returned when an expected line doesn't arrive in time
+var ErrTimeout = errors.New("irctest: timed out waiting for a line")
+
+// Expect waits for the next line that satisfies match,
+// lines before the match are skipped and won't be matched again
+func (s *Server) Expect(timeout time.Duration, match func(Line) bool) (Line, error) {
+	deadline := time.Now().Add(timeout)
+	timer := time.AfterFunc(timeout, func() {
+		s.mu.Lock()
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	})
+	defer timer.Stop()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		for i := s.cursor; i < len(s.lines); i++ {
+			if match(s.lines[i]) {
+				s.cursor = i + 1
+				return s.lines[i], nil
+			}
+		}
+		if s.closed || time.Now().After(deadline) {
+			return Line{}, ErrTimeout
+		}
+		s.cond.Wait()
+	}
+}
+
+// ExpectMsg waits for the next PRIVMSG from nick to target and returns its text
+func (s *Server) ExpectMsg(timeout time.Duration, nick, target string) (string, error) {
+	l, err := s.Expect(timeout, func(l Line) bool {
+		return l.Command == "PRIVMSG" && l.Nick == nick &&
+			strings.EqualFold(l.Param(0), target)
+	})
+	return l.Param(1), err
+}
+
+// WaitJoin waits until nick has joined the channel
+func (s *Server) WaitJoin(timeout time.Duration, nick, ch string) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		for c := range s.channels[strings.ToLower(ch)] {
+			if c.nick == nick {
+				s.mu.Unlock()
+				return nil
+			}
+		}
+		s.mu.Unlock()
+		time.Sleep(time.Millisecond * 10)
+	}
+	return ErrTimeout
+}
+
+// parse parses a raw client line, the prefix is dropped
+func parse(raw string) Line {
+	l := Line{Raw: raw, Tags: make(map[string]string)}
+	rest := raw
+	if strings.HasPrefix(rest, "@") {
+		if i := strings.IndexByte(rest, ' '); i >= 0 {
+			for _, tag := range strings.Split(rest[1:i], ";") {
+				kv := strings.SplitN(tag, "=", 2)
+				if len(kv) == 2 {
+					l.Tags[kv[0]] = tagUnescaper.Replace(kv[1])
+				} else {
+					l.Tags[kv[0]] = ""
+				}
+			}
+			rest = rest[i+1:]
+		}
+	}
+	if strings.HasPrefix(rest, ":") {
+		if i := strings.IndexByte(rest, ' '); i >= 0 {
+			rest = rest[i+1:]
+		}
+	}
+	var trailing *string
+	if i := strings.Index(rest, " :"); i >= 0 {
+		t := rest[i+2:]
+		trailing = &t
+		rest = rest[:i]
+	} else if strings.HasPrefix(rest, ":") {
+		t := rest[1:]
+		trailing = &t
+		rest = ""
+	}
+	fields := strings.Fields(rest)
+	if len(fields) > 0 {
+		l.Command = strings.ToUpper(fields[0])
+		l.Params = fields[1:]
+	}
+	if trailing != nil {
+		l.Params = append(l.Params, *trailing)
+	}
+	return l
+}
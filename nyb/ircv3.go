@@ -0,0 +1,412 @@
+package nyb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ugjka/ircmsg"
+	kitty "github.com/ugjka/kittybot"
+	"github.com/ugjka/newyearsbot/audit"
+)
+
+// IRCv3 capabilities
+const (
+	capEcho      = "echo-message"
+	capLabeled   = "labeled-response"
+	capBatch     = "batch"
+	capMultiline = "draft/multiline"
+	// Services accounts of the senders, the users' saved locations follow the account
+	capAccountTag = "account-tag"
+	capTags       = kitty.CapMessageTags
+)
+
+// Capabilities the bot requests itself,
+// kittybot requests server-time and message-tags on its own
+var botCaps = []string{capEcho, capLabeled, capBatch, capMultiline, capAccountTag}
+
+// How long to wait for the echo of an announcement
+const echoTimeout = time.Minute
+
+// ircv3 is the IRCv3 state of the current connection
+type ircv3 struct {
+	offered map[string]string
+	enabled map[string]bool
+	// CAP LS 302 can span several lines
+	ls []string
+	// Own CAP REQs waiting for an answer
+	pending int
+	seq     int
+	// Announcements waiting for their echo
+	echoes []*echo
+	// Own echoed batches
+	batches map[string]bool
+	sync.Mutex
+}
+
+// echo is an announcement waiting to be echoed back by the server
+type echo struct {
+	label  string
+	target string
+	text   string
+	rec    audit.Record
+}
+
+func (v *ircv3) reset() {
+	v.Lock()
+	v.offered = make(map[string]string)
+	v.enabled = make(map[string]bool)
+	v.ls = nil
+	v.pending = 0
+	v.echoes = nil
+	v.batches = make(map[string]bool)
+	v.Unlock()
+}
+
+func (v *ircv3) has(cap string) bool {
+	v.Lock()
+	defer v.Unlock()
+	return v.enabled[cap]
+}
+
+func (v *ircv3) next(prefix string) string {
+	v.Lock()
+	defer v.Unlock()
+	v.seq++
+	return prefix + strconv.Itoa(v.seq)
+}
+
+// multiline returns the server's draft/multiline limits
+func (v *ircv3) multiline() (maxBytes, maxLines int, ok bool) {
+	v.Lock()
+	defer v.Unlock()
+	if !v.enabled[capMultiline] || !v.enabled[capBatch] {
+		return 0, 0, false
+	}
+	for _, kv := range strings.Split(v.offered[capMultiline], ",") {
+		k, val, _ := strings.Cut(kv, "=")
+		n, _ := strconv.Atoi(val)
+		switch k {
+		case "max-bytes":
+			maxBytes = n
+		case "max-lines":
+			maxLines = n
+		}
+	}
+	return maxBytes, maxLines, maxBytes > 0
+}
+
+// capLS rewrites kittybot's CAP LS to CAP LS 302 to see the capability values
+func (bot *Settings) capLS(line []byte) []byte {
+	if strings.TrimSpace(string(line)) == "CAP LS" {
+		return []byte("CAP LS 302\r\n")
+	}
+	return line
+}
+
+// capReq adds our own CAP REQ in front of kittybot's,
+// a separate request so that a NAK doesn't break kittybot's negotiation
+func (bot *Settings) capReq(line []byte) []byte {
+	if !strings.HasPrefix(string(line), "CAP REQ ") {
+		return line
+	}
+	v := &bot.v3
+	v.Lock()
+	defer v.Unlock()
+	var caps []string
+	for _, cap := range botCaps {
+		if _, ok := v.offered[cap]; ok {
+			caps = append(caps, cap)
+		}
+	}
+	if len(caps) == 0 {
+		return line
+	}
+	v.pending++
+	return append([]byte("CAP REQ :"+strings.Join(caps, " ")+"\r\n"), line...)
+}
+
+// incoming handles the lines from the server before kittybot sees them,
+// returns the line to pass to kittybot or nil to drop it
+func (bot *Settings) incoming(server string, line []byte) []byte {
+	m := ircmsg.ParseMessage(string(line))
+	if m == nil {
+		return line
+	}
+	bot.checkBan(server, m)
+	// Before kittybot fires Joined and the scheduler starts sending
+	if m.Command == "001" {
+		bot.setConnected(true)
+	}
+	v := &bot.v3
+	switch m.Command {
+	case "CAP":
+		return bot.capReply(m, line)
+	case "ACK":
+		// labeled-response acknowledgment of a message without a reply
+		return nil
+	case "PRIVMSG", "NOTICE", "TAGMSG", "BATCH":
+		if m.Prefix != nil && strings.EqualFold(m.Prefix.Name, bot.irc.Prefix().Name) {
+			bot.echoed(m)
+			return nil
+		}
+		// The end of an own batch might come from the server
+		if m.Command == "BATCH" && strings.HasPrefix(m.Param(0), "-") {
+			v.Lock()
+			own := v.batches[m.Param(0)[1:]]
+			delete(v.batches, m.Param(0)[1:])
+			v.Unlock()
+			if own {
+				return nil
+			}
+		}
+	default:
+		if label, ok := m.GetTag("label"); ok && isErrorNumeric(m.Command) {
+			bot.rejected(label, m)
+		}
+	}
+	return line
+}
+
+func (bot *Settings) capReply(m *ircmsg.Message, line []byte) []byte {
+	v := &bot.v3
+	v.Lock()
+	defer v.Unlock()
+	switch m.Param(1) {
+	case "LS":
+		v.ls = append(v.ls, strings.Fields(m.Trailing())...)
+		if m.Param(2) == "*" {
+			return nil
+		}
+		var names []string
+		for _, cap := range v.ls {
+			name, value, _ := strings.Cut(cap, "=")
+			v.offered[name] = value
+			names = append(names, name)
+		}
+		v.ls = nil
+		// kittybot doesn't understand the values
+		prefix := ""
+		if m.Prefix != nil {
+			prefix = ":" + m.Prefix.String() + " "
+		}
+		return []byte(fmt.Sprintf("%sCAP %s LS :%s\r\n", prefix, m.Param(0), strings.Join(names, " ")))
+	case "ACK":
+		for _, cap := range strings.Fields(m.Trailing()) {
+			if strings.HasPrefix(cap, "-") {
+				delete(v.enabled, cap[1:])
+				continue
+			}
+			v.enabled[cap] = true
+		}
+		if v.pending > 0 {
+			v.pending--
+			bot.irc.Info("ircv3", "capabilities", m.Trailing())
+			return nil
+		}
+	case "NAK":
+		if v.pending > 0 {
+			v.pending--
+			bot.irc.Warn("ircv3 capabilities rejected", "capabilities", m.Trailing())
+			return nil
+		}
+	case "DEL":
+		for _, cap := range strings.Fields(m.Trailing()) {
+			delete(v.enabled, cap)
+		}
+	}
+	return line
+}
+
+// expectEcho registers an announcement to be confirmed by its echo
+func (bot *Settings) expectEcho(e *echo) {
+	v := &bot.v3
+	v.Lock()
+	v.echoes = append(v.echoes, e)
+	v.Unlock()
+	time.AfterFunc(echoTimeout, func() {
+		if bot.takeEcho(func(x *echo) bool { return x == e }) != nil {
+			undeliveredCounter.Inc(bot.server())
+			bot.schedLog.Warn("announcement not echoed", "channel", e.target,
+				"offset", e.rec.Offset, "timeout", echoTimeout)
+		}
+	})
+}
+
+func (bot *Settings) takeEcho(match func(*echo) bool) *echo {
+	v := &bot.v3
+	v.Lock()
+	defer v.Unlock()
+	for i, e := range v.echoes {
+		if match(e) {
+			v.echoes = append(v.echoes[:i], v.echoes[i+1:]...)
+			return e
+		}
+	}
+	return nil
+}
+
+// echoed handles own messages echoed back by the server
+func (bot *Settings) echoed(m *ircmsg.Message) {
+	if m.Command == "BATCH" {
+		ref := m.Param(0)
+		bot.v3.Lock()
+		if strings.HasPrefix(ref, "-") {
+			delete(bot.v3.batches, ref[1:])
+			bot.v3.Unlock()
+			return
+		}
+		bot.v3.batches[strings.TrimPrefix(ref, "+")] = true
+		bot.v3.Unlock()
+	}
+	label, labeled := m.GetTag("label")
+	target, text := m.Param(0), m.Trailing()
+	if m.Command == "BATCH" {
+		target = m.Param(2)
+		text = ""
+	}
+	e := bot.takeEcho(func(e *echo) bool {
+		if labeled {
+			return e.label == label
+		}
+		return e.label == "" && strings.EqualFold(e.target, target) && e.text == text
+	})
+	if e == nil {
+		return
+	}
+	delivered := bot.now().UTC()
+	if ts, ok := m.GetTag("time"); ok {
+		if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+			delivered = t.UTC()
+		}
+	}
+	rec := e.rec
+	rec.Event = audit.Delivered
+	rec.Delivered = delivered
+	bot.audit(rec)
+	lateness := delivered.Sub(rec.Scheduled)
+	deliveryHistogram.Observe(lateness.Seconds(), bot.server())
+	bot.schedLog.Info("announcement delivered", "offset", rec.Offset,
+		"channel", rec.Channel, "lateness", lateness)
+}
+
+// rejected handles labeled error replies to announcements
+func (bot *Settings) rejected(label string, m *ircmsg.Message) {
+	e := bot.takeEcho(func(e *echo) bool { return e.label == label })
+	if e == nil {
+		return
+	}
+	undeliveredCounter.Inc(bot.server())
+	bot.schedLog.Error("announcement rejected", "channel", e.target,
+		"offset", e.rec.Offset, "error", m.Command+" "+m.Trailing())
+}
+
+// send sends text to target with the message tags, each line waits for the limiter
+func (bot *Settings) send(target, text string, tags []string, announcement *audit.Record) {
+	if bot.Limit {
+		for range splitLines(text, bot.irc.MsgMaxSize(target)) {
+			bot.limiter.wait(1)
+		}
+	}
+	bot.write(target, text, tags, announcement)
+}
+
+// write sends text to target with the message tags past the limiter,
+// multi-line text goes out as a single draft/multiline batch when the server supports it.
+// An announcement is confirmed when the server echoes it back
+func (bot *Settings) write(target, text string, tags []string, announcement *audit.Record) {
+	irc := bot.irc
+	// kittybot would queue the messages for the next connection
+	if !bot.isConnected() {
+		bot.irc.Debug("not connected, dropping message", "target", target)
+		return
+	}
+	lines := splitLines(text, irc.MsgMaxSize(target))
+	if len(lines) == 0 {
+		return
+	}
+	var e *echo
+	if announcement != nil && bot.v3.has(capEcho) {
+		e = &echo{target: target, text: lines[0], rec: *announcement}
+		if bot.v3.has(capLabeled) {
+			e.label = bot.v3.next("nyb")
+			tags = append(tags, "label="+e.label)
+		}
+		bot.expectEcho(e)
+	}
+	bot.sendMu.Lock()
+	defer bot.sendMu.Unlock()
+	if maxBytes, maxLines, ok := bot.v3.multiline(); ok && len(lines) > 1 &&
+		(maxLines == 0 || len(lines) <= maxLines) && len(strings.Join(lines, "\n")) <= maxBytes {
+		ref := bot.v3.next("b")
+		irc.Send(tagged(tags) + "BATCH +" + ref + " " + capMultiline + " " + target)
+		for _, line := range lines {
+			irc.Send("@batch=" + ref + " PRIVMSG " + target + " :" + line)
+		}
+		irc.Send("BATCH -" + ref)
+		return
+	}
+	if len(tags) == 0 {
+		irc.Msg(target, text)
+		return
+	}
+	for i, line := range lines {
+		if i == 0 || e == nil {
+			irc.Send(tagged(tags) + "PRIVMSG " + target + " :" + line)
+			continue
+		}
+		// Only the first line is labeled
+		irc.Send("PRIVMSG " + target + " :" + line)
+	}
+}
+
+func isErrorNumeric(command string) bool {
+	if len(command) != 3 || (command[0] != '4' && command[0] != '5') {
+		return false
+	}
+	_, err := strconv.Atoi(command)
+	return err == nil
+}
+
+func tagged(tags []string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	return "@" + strings.Join(tags, ";") + " "
+}
+
+var tagEscaper = strings.NewReplacer(`\`, `\\`, ";", `\:`, " ", `\s`, "\r", `\r`, "\n", `\n`)
+
+// replyTags returns the tags threading a reply to the message
+func (bot *Settings) replyTags(m *kitty.Message) []string {
+	msgid, ok := m.GetTag("msgid")
+	if !ok || msgid == "" || !bot.v3.has(capTags) {
+		return nil
+	}
+	return []string{"+draft/reply=" + tagEscaper.Replace(msgid)}
+}
+
+// splitLines splits the text into lines of max bytes like kittybot does
+func splitLines(text string, max int) []string {
+	var lines []string
+	text = strings.ToValidUTF8(text, "")
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		line = strings.TrimRight(line, "\r")
+		for len(line) > max {
+			size := 0
+			for _, r := range line {
+				if size+utf8.RuneLen(r) > max {
+					break
+				}
+				size += utf8.RuneLen(r)
+			}
+			lines = append(lines, line[:size])
+			line = line[size:]
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
@@ -0,0 +1,103 @@
+package nyb_test
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ugjka/newyearsbot/audit"
+	"github.com/ugjka/newyearsbot/nyb"
+	"github.com/ugjka/newyearsbot/nyb/irctest"
+)
+
+// expectBatch waits for a draft/multiline batch to target and returns its start and lines
+func (e *e2e) expectBatch(target string) (irctest.Line, []string) {
+	e.t.Helper()
+	start, err := e.srv.Expect(timeout, func(l irctest.Line) bool {
+		return l.Command == "BATCH" && strings.HasPrefix(l.Param(0), "+") &&
+			l.Param(1) == "draft/multiline" && l.Param(2) == target
+	})
+	if err != nil {
+		e.t.Fatal("expected a batch:", err)
+	}
+	ref := start.Param(0)[1:]
+	var lines []string
+	for {
+		l, err := e.srv.Expect(timeout, func(l irctest.Line) bool {
+			return (l.Command == "BATCH" && l.Param(0) == "-"+ref) ||
+				(l.Command == "PRIVMSG" && l.Tags["batch"] == ref)
+		})
+		if err != nil {
+			e.t.Fatal("unfinished batch:", err)
+		}
+		if l.Command == "BATCH" {
+			return start, lines
+		}
+		lines = append(lines, l.Param(1))
+	}
+}
+
+func TestE2EIRCv3(t *testing.T) {
+	t.Parallel()
+	srv := newServer(t)
+	srv.Caps = []string{"server-time", "message-tags", "echo-message", "labeled-response",
+		"batch", "draft/multiline=max-bytes=4096,max-lines=24"}
+	auditFile := filepath.Join(t.TempDir(), "audit.jsonl")
+	auditLog, err := audit.Open(auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A minute before the new year in UTC+1, the zone list doesn't fit in a line
+	start := time.Date(2024, time.December, 31, 22, 59, 0, 0, time.UTC)
+	// The channel key stays out of the audit log
+	e := startBot(t, srv, "e2eircv3", start, func(s *nyb.Settings) {
+		s.Channels = []string{"#test:hunter2"}
+		s.Audit = auditLog
+		srv.Now = s.Clock.Now
+	})
+
+	for _, cap := range []string{"CAP LS 302", "CAP REQ :echo-message labeled-response batch draft/multiline"} {
+		if _, err := srv.Expect(0, func(l irctest.Line) bool { return l.Raw == cap }); err != nil {
+			t.Errorf("expected %q", cap)
+		}
+	}
+
+	_, lines := e.expectBatch("#test")
+	if len(lines) < 2 || !strings.HasPrefix(lines[0], "Next New Year in 53 seconds in Albania, ") ||
+		!strings.HasSuffix(lines[len(lines)-1], "Vatican") {
+		t.Errorf("unexpected zone batch: %q", lines)
+	}
+	e.expect("#test", helpText)
+
+	// Replies are threaded
+	msgid := srv.Privmsg("user", "#test", "!source")
+	reply, err := srv.Expect(timeout, func(l irctest.Line) bool {
+		return l.Command == "PRIVMSG" && l.Nick == e.nick
+	})
+	if err != nil {
+		t.Fatal("no reply:", err)
+	}
+	if reply.Param(1) != "https://github.com/ugjka/newyearsbot" || reply.Tags["+draft/reply"] != msgid {
+		t.Errorf("expected a reply to %s; got %q", msgid, reply.Raw)
+	}
+
+	// The announcement is labeled and confirmed by its echo
+	e.clock.Advance(time.Minute)
+	happy, err := srv.Expect(timeout, func(l irctest.Line) bool {
+		return l.Command == "PRIVMSG" && l.Nick == e.nick
+	})
+	if err != nil {
+		t.Fatal("no announcement:", err)
+	}
+	if happy.Tags["label"] == "" || !strings.HasPrefix(happy.Param(1), "Happy New Year in Albania, ") {
+		t.Errorf("unexpected announcement: %q", happy.Raw)
+	}
+	midnight := time.Date(2024, time.December, 31, 23, 0, 0, 0, time.UTC)
+	r := waitAudit(t, auditFile, func(r audit.Record) bool { return r.Event == audit.Delivered })
+	// The server time is the fake clock, which the bot advances while waiting for the next zone
+	if r.Offset != 1 || r.Channel != "#test" || r.Target != 2025 || !r.Scheduled.Equal(midnight) ||
+		r.Delivered.Before(r.Sent) || r.Delivered.Sub(midnight) > time.Second*10 {
+		t.Errorf("unexpected delivered record: %+v", r)
+	}
+}
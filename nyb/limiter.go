@@ -0,0 +1,49 @@
+package nyb
+
+import (
+	"sync"
+	"time"
+)
+
+// limiter is a token bucket for all the messages the bot sends,
+// replies are dropped when it's empty and the other messages wait
+type limiter struct {
+	limit    int
+	interval time.Duration
+	tokens   float64
+	last     time.Time
+	sync.Mutex
+}
+
+func newLimiter(limit int, interval time.Duration) *limiter {
+	return &limiter{
+		limit:    limit,
+		interval: interval,
+		tokens:   float64(limit),
+		last:     time.Now(),
+	}
+}
+
+// take takes n tokens, it returns false when there are not enough
+func (l *limiter) take(n int) bool {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	l.tokens += float64(l.limit) * float64(now.Sub(l.last)) / float64(l.interval)
+	if l.tokens > float64(l.limit) {
+		l.tokens = float64(l.limit)
+	}
+	l.last = now
+	if l.tokens < float64(n) {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
+
+// wait takes n tokens, waiting for them, n is at most the limit
+func (l *limiter) wait(n int) {
+	for !l.take(n) {
+		time.Sleep(l.interval / time.Duration(l.limit))
+	}
+}
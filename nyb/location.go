@@ -0,0 +1,241 @@
+package nyb
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ugjka/go-tz/v2"
+	"github.com/ugjka/newyearsbot/audit"
+)
+
+// place is a location with its time zone
+type place struct {
+	name string
+	zone *time.Location
+}
+
+var (
+	// utc+5:45, gmt-3, +10 or utc
+	offsetReg = regexp.MustCompile(`^(?i:utc|gmt)?\s*(?:([+-])\s*(\d{1,2})(?::?(\d{2}))?)?$`)
+	// 56.95,24.1 or 56.95 24.1
+	coordsReg = regexp.MustCompile(`^([+-]?\d{1,2}(?:\.\d+)?)\s*[,\s]\s*([+-]?\d{1,3}(?:\.\d+)?)$`)
+)
+
+const (
+	// Geocoder results to look for the same name in other time zones
+	candidates = 5
+	// How long a user can pick one of the offered places
+	choiceWindow = time.Minute * 2
+)
+
+// locate finds the location's time zone, IANA zone names, UTC offsets and lat,lon coordinates
+// are answered without a network call, free text is geocoded.
+// A number picks one of the places offered to the user for an ambiguous location
+func (bot *Settings) locate(user, location string) (place, error) {
+	location = strings.TrimSpace(location)
+	if p, ok := bot.choice(user, location); ok {
+		return p, nil
+	}
+	if p, ok, err := parseOffset(location); ok {
+		return p, err
+	}
+	if p, ok, err := parseCoords(location); ok {
+		return p, err
+	}
+	if p, ok := parseZone(location); ok {
+		return p, nil
+	}
+	res, err := bot.geocode(normalize(location))
+	if err != nil {
+		return place{}, err
+	}
+	if len(res) == 0 {
+		return place{}, errNoPlace
+	}
+	// The first place of every time zone
+	var places []place
+	zones := make(map[string]bool)
+	for _, r := range res {
+		zone, err := pointZone(r.Lat, r.Lon)
+		if err != nil || zones[zone.String()] {
+			continue
+		}
+		zones[zone.String()] = true
+		places = append(places, place{name: r.DisplayName, zone: zone})
+	}
+	switch len(places) {
+	case 0:
+		return place{}, errNoZone
+	case 1:
+		return places[0], nil
+	}
+	bot.offer(user, places)
+	return place{}, ambiguous{places: places, prefix: bot.Prefix}
+}
+
+// ambiguous is a location found in several time zones
+type ambiguous struct {
+	places []place
+	prefix string
+	// The command to pick with, !hny or !time by default
+	command string
+}
+
+func (a ambiguous) Error() string {
+	var list []string
+	for i, p := range a.places {
+		list = append(list, fmt.Sprintf("%d) %s (%s)", i+1, shortName(p.name), p.zone))
+	}
+	if a.command != "" {
+		return fmt.Sprintf("Which one? %s. Pick with %s%s <number>", strings.Join(list, " "), a.prefix, a.command)
+	}
+	return fmt.Sprintf("Which one? %s. Pick with %shny <number> or %stime <number>",
+		strings.Join(list, " "), a.prefix, a.prefix)
+}
+
+// shortName keeps the place and the country of a geocoder's display name
+func shortName(name string) string {
+	parts := strings.Split(name, ", ")
+	if len(parts) <= 2 {
+		return name
+	}
+	return parts[0] + ", " + parts[len(parts)-1]
+}
+
+// choices are the places offered to the users, by nick
+type choices struct {
+	offers map[string]offer
+	sync.Mutex
+}
+
+type offer struct {
+	places  []place
+	expires time.Time
+}
+
+func (bot *Settings) offer(user string, places []place) {
+	bot.choices.Lock()
+	defer bot.choices.Unlock()
+	if bot.choices.offers == nil {
+		bot.choices.offers = make(map[string]offer)
+	}
+	now := bot.realNow()
+	for nick, o := range bot.choices.offers {
+		if now.After(o.expires) {
+			delete(bot.choices.offers, nick)
+		}
+	}
+	bot.choices.offers[strings.ToLower(user)] = offer{places: places, expires: now.Add(choiceWindow)}
+}
+
+// choice returns the offered place picked by the user's number
+func (bot *Settings) choice(user, location string) (place, bool) {
+	n, err := strconv.Atoi(location)
+	if err != nil {
+		return place{}, false
+	}
+	bot.choices.Lock()
+	defer bot.choices.Unlock()
+	o, ok := bot.choices.offers[strings.ToLower(user)]
+	if !ok || bot.realNow().After(o.expires) || n < 1 || n > len(o.places) {
+		return place{}, false
+	}
+	return o.places[n-1], true
+}
+
+// parseOffset parses a UTC offset, ok is false if the location isn't one
+func parseOffset(location string) (p place, ok bool, err error) {
+	m := offsetReg.FindStringSubmatch(location)
+	if m == nil || location == "" {
+		return place{}, false, nil
+	}
+	// A bare number is more likely a place, like a zip code
+	if m[1] == "" && !strings.EqualFold(location, "utc") && !strings.EqualFold(location, "gmt") {
+		return place{}, false, nil
+	}
+	hours, _ := strconv.Atoi(m[2])
+	minutes, _ := strconv.Atoi(m[3])
+	if hours > 14 || minutes >= 60 {
+		return place{}, true, errNoZone
+	}
+	if hours == 0 && minutes == 0 {
+		return place{name: "UTC", zone: time.UTC}, true, nil
+	}
+	offset := hours*3600 + minutes*60
+	if m[1] == "-" {
+		offset = -offset
+	}
+	name := audit.OffsetName(float64(offset) / 3600)
+	return place{name: name, zone: time.FixedZone(name, offset)}, true, nil
+}
+
+// parseCoords parses lat,lon coordinates, ok is false if the location isn't one
+func parseCoords(location string) (p place, ok bool, err error) {
+	m := coordsReg.FindStringSubmatch(location)
+	if m == nil {
+		return place{}, false, nil
+	}
+	lat, _ := strconv.ParseFloat(m[1], 64)
+	lon, _ := strconv.ParseFloat(m[2], 64)
+	if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return place{}, true, errNoPlace
+	}
+	zone, err := pointZone(lat, lon)
+	if err != nil {
+		return place{}, true, err
+	}
+	return place{name: fmt.Sprintf("%g, %g (%s)", lat, lon, zone), zone: zone}, true, nil
+}
+
+// zoneWords are lowercase in the IANA zone names, e.g. America/Port_of_Spain
+var zoneWords = map[string]bool{"of": true, "au": true, "es": true, "de": true, "du": true}
+
+// parseZone loads an IANA zone name like Europe/Riga, the case doesn't matter
+func parseZone(location string) (place, bool) {
+	if !strings.Contains(location, "/") || strings.ContainsAny(location, " .\\") {
+		return place{}, false
+	}
+	for _, name := range []string{location, zoneCase(location, false), zoneCase(location, true)} {
+		if zone, err := time.LoadLocation(name); err == nil {
+			return place{name: zone.String(), zone: zone}, true
+		}
+	}
+	return place{}, false
+}
+
+// zoneCase capitalizes the words of a zone name, small keeps the zoneWords lowercase
+func zoneCase(name string, small bool) string {
+	var b strings.Builder
+	start := 0
+	for i := 0; i <= len(name); i++ {
+		if i < len(name) && !strings.ContainsRune("/_-", rune(name[i])) {
+			continue
+		}
+		word := strings.ToLower(name[start:i])
+		if word != "" && !(small && zoneWords[word]) {
+			word = strings.ToUpper(word[:1]) + word[1:]
+		}
+		b.WriteString(word)
+		if i < len(name) {
+			b.WriteByte(name[i])
+		}
+		start = i + 1
+	}
+	return b.String()
+}
+
+func pointZone(lat, lon float64) (*time.Location, error) {
+	tzid, err := tz.GetZone(tz.Point{Lat: lat, Lon: lon})
+	if err != nil {
+		return nil, errNoZone
+	}
+	zone, err := time.LoadLocation(tzid[0])
+	if err != nil {
+		return nil, errNoZone
+	}
+	return zone, nil
+}
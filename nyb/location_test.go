@@ -0,0 +1,98 @@
+package nyb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ugjka/newyearsbot/audit"
+	"github.com/ugjka/newyearsbot/nyb/clock/clocktest"
+)
+
+func TestParseLocation(t *testing.T) {
+	tt := []struct {
+		input  string
+		name   string
+		offset int
+	}{
+		{"UTC", "UTC", 0},
+		{"gmt", "UTC", 0},
+		{"utc+5:45", "UTC+5:45", 5*3600 + 45*60},
+		{"UTC-0930", "UTC-9:30", -(9*3600 + 30*60)},
+		{"+14", "UTC+14", 14 * 3600},
+		{"utc - 3", "UTC-3", -3 * 3600},
+		{"56.95,24.1", "56.95, 24.1 (Europe/Riga)", 2 * 3600},
+		{"-33.87 151.21", "-33.87, 151.21 (Australia/Sydney)", 11 * 3600},
+		{"Europe/Riga", "Europe/Riga", 2 * 3600},
+		{"america/port-au-prince", "America/Port-au-Prince", -5 * 3600},
+		{"AMERICA/ARGENTINA/BUENOS_AIRES", "America/Argentina/Buenos_Aires", -3 * 3600},
+	}
+	target := time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+	bot := &Settings{}
+	for _, tc := range tt {
+		p, err := bot.locate("user", tc.input)
+		if err != nil {
+			t.Errorf("%s: %v", tc.input, err)
+			continue
+		}
+		if p.name != tc.name {
+			t.Errorf("%s: expected %q; got %q", tc.input, tc.name, p.name)
+		}
+		if offset := zoneOffset(target, p.zone); offset != time.Duration(tc.offset)*time.Second {
+			t.Errorf("%s: expected offset %d; got %v", tc.input, tc.offset, offset)
+		}
+	}
+	for _, input := range []string{"utc+15", "utc+5:60", "91,0", "0,181"} {
+		if _, err := bot.locate("user", input); err == nil {
+			t.Errorf("%s: expected an error", input)
+		}
+	}
+	// Not offsets, coordinates or zones, left to the geocoder
+	for _, input := range []string{"12345", "riga", "Local", "new york", "europe/../riga"} {
+		_, ok, _ := parseOffset(input)
+		_, coords, _ := parseCoords(input)
+		_, zone := parseZone(input)
+		if ok || coords || zone {
+			t.Errorf("%s: unexpected offline match", input)
+		}
+	}
+}
+
+func TestChoice(t *testing.T) {
+	clk := clocktest.New(time.Date(2024, time.December, 31, 9, 0, 0, 0, time.UTC))
+	wall := clocktest.New(time.Date(2024, time.December, 31, 9, 0, 0, 0, time.UTC))
+	bot := &Settings{Clock: clk, RealClock: wall}
+	places := []place{{name: "Paris, France", zone: time.UTC}, {name: "Paris, United States", zone: time.UTC}}
+	bot.offer("User", places)
+	if p, ok := bot.choice("user", "2"); !ok || p.name != "Paris, United States" {
+		t.Errorf("unexpected choice: %+v", p)
+	}
+	for _, pick := range []string{"0", "3", "paris"} {
+		if _, ok := bot.choice("user", pick); ok {
+			t.Errorf("%s: unexpected choice", pick)
+		}
+	}
+	if _, ok := bot.choice("other", "1"); ok {
+		t.Error("another user picked the place")
+	}
+	// A simulated clock doesn't shorten the window
+	clk.Advance(time.Hour)
+	if _, ok := bot.choice("user", "1"); !ok {
+		t.Error("the place expired with the simulated time")
+	}
+	wall.Advance(choiceWindow + time.Second)
+	if _, ok := bot.choice("user", "1"); ok {
+		t.Error("picked an expired place")
+	}
+}
+
+func TestOffsetHours(t *testing.T) {
+	for _, offset := range []float64{0, 2, 5.75, -9.5, 12.75} {
+		name := audit.OffsetName(offset)
+		if got, ok := offsetHours(name); !ok || got != offset {
+			t.Errorf("%s: expected %v; got %v", name, offset, got)
+		}
+	}
+	if got, ok := offsetHours("9:30"); !ok || got != 9.5 {
+		t.Errorf("9:30: expected 9.5; got %v", got)
+	}
+}
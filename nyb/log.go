@@ -0,0 +1,193 @@
+package nyb
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// Logging subsystems
+const (
+	LogIRC       = "irc"
+	LogGeocoder  = "geocoder"
+	LogScheduler = "scheduler"
+)
+
+// LogConfig configures the bot's logging
+type LogConfig struct {
+	// Output format: terminal (default), logfmt or json
+	Format string
+	// Log to this file instead of stderr
+	File string
+	// Rotate the file after it grows over MaxSize megabytes, 0 disables rotation
+	MaxSize int
+	// Number of rotated files to keep
+	MaxBackups int
+	// Log levels per subsystem (irc, geocoder, scheduler), default is info
+	Levels map[string]string
+}
+
+// Check validates the log configuration
+func (c LogConfig) Check() error {
+	if _, err := logFormat(c.Format); err != nil {
+		return err
+	}
+	if c.MaxSize < 0 || c.MaxBackups < 0 {
+		return fmt.Errorf("negative log rotation size or backups")
+	}
+	for subsys, lvl := range c.Levels {
+		switch subsys {
+		case LogIRC, LogGeocoder, LogScheduler:
+		default:
+			return fmt.Errorf("unknown log subsystem: %s", subsys)
+		}
+		if _, err := log.LvlFromString(lvl); err != nil {
+			return fmt.Errorf("invalid log level for %s: %s", subsys, lvl)
+		}
+	}
+	return nil
+}
+
+func logFormat(format string) (log.Format, error) {
+	switch format {
+	case "", "terminal":
+		return log.TerminalFormat(), nil
+	case "logfmt":
+		return log.LogfmtFormat(), nil
+	case "json":
+		return log.JsonFormat(), nil
+	}
+	return nil, fmt.Errorf("unknown log format: %s", format)
+}
+
+// LogLvl sets the log level for all the subsystems
+func (bot *Settings) LogLvl(Lvl log.Lvl) {
+	bot.setHandlers(log.StderrHandler, func(string) log.Lvl {
+		return Lvl
+	})
+}
+
+// Logging sets up the bot's logging
+func (bot *Settings) Logging(c LogConfig) error {
+	if err := c.Check(); err != nil {
+		return err
+	}
+	format, _ := logFormat(c.Format)
+	var w io.Writer = os.Stderr
+	if c.File != "" {
+		f, err := openLogFile(c.File, c.MaxSize, c.MaxBackups)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+	handler := log.StreamHandler(w, format)
+	bot.setHandlers(handler, func(subsys string) log.Lvl {
+		lvl, err := log.LvlFromString(c.Levels[subsys])
+		if err != nil {
+			return log.LvlInfo
+		}
+		return lvl
+	})
+	return nil
+}
+
+func (bot *Settings) setHandlers(h log.Handler, level func(string) log.Lvl) {
+	bot.irc.Logger.SetHandler(log.LvlFilterHandler(level(LogIRC), h))
+	bot.geoLog.SetHandler(log.LvlFilterHandler(level(LogGeocoder), h))
+	bot.schedLog.SetHandler(log.LvlFilterHandler(level(LogScheduler), h))
+}
+
+// Log files are shared between the bots
+var logFiles = struct {
+	files map[string]*rotatingFile
+	sync.Mutex
+}{
+	files: make(map[string]*rotatingFile),
+}
+
+func openLogFile(path string, maxSize, maxBackups int) (*rotatingFile, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	logFiles.Lock()
+	defer logFiles.Unlock()
+	if f, ok := logFiles.files[abs]; ok {
+		return f, nil
+	}
+	f := &rotatingFile{
+		path:       abs,
+		maxSize:    int64(maxSize) * 1024 * 1024,
+		maxBackups: maxBackups,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	logFiles.files[abs] = f
+	return f, nil
+}
+
+// rotatingFile is a log file that is rotated after it grows over maxSize
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	size       int64
+	file       *os.File
+	sync.Mutex
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (n int, err error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err = f.file.Write(p)
+	f.size += int64(n)
+	return
+}
+
+// rotate shifts file.1 to file.2 and so on, dropping the oldest backup
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if f.maxBackups == 0 {
+		os.Remove(f.path)
+		return f.open()
+	}
+	backup := func(i int) string {
+		return fmt.Sprintf("%s.%d", f.path, i)
+	}
+	os.Remove(backup(f.maxBackups))
+	for i := f.maxBackups - 1; i > 0; i-- {
+		os.Rename(backup(i), backup(i+1))
+	}
+	if err := os.Rename(f.path, backup(1)); err != nil {
+		return err
+	}
+	return f.open()
+}
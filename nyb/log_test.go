@@ -0,0 +1,66 @@
+package nyb
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nyb.log")
+	f := &rotatingFile{
+		path:       path,
+		maxSize:    10,
+		maxBackups: 2,
+	}
+	if err := f.open(); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.file.Close()
+	expected := map[string]string{
+		path:        "dddddddd\n",
+		path + ".1": "cccccccc\n",
+		path + ".2": "bbbbbbbb\n",
+	}
+	for file, content := range expected {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("%s: expected %q; got %q", file, content, data)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Error("too many backups kept")
+	}
+}
+
+func TestLogConfigCheck(t *testing.T) {
+	tt := []struct {
+		config LogConfig
+		err    string
+	}{
+		{LogConfig{}, ""},
+		{LogConfig{Format: "json", Levels: map[string]string{"irc": "debug"}}, ""},
+		{LogConfig{Format: "xml"}, "unknown log format"},
+		{LogConfig{Levels: map[string]string{"dns": "info"}}, "unknown log subsystem"},
+		{LogConfig{Levels: map[string]string{"geocoder": "loud"}}, "invalid log level"},
+		{LogConfig{MaxSize: -1}, "negative"},
+	}
+	for _, tc := range tt {
+		err := tc.config.Check()
+		if tc.err == "" && err != nil {
+			t.Errorf("%+v: unexpected error: %v", tc.config, err)
+		}
+		if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%+v: expected error %q; got %v", tc.config, tc.err, err)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package nyb
+
+import "github.com/ugjka/newyearsbot/metrics"
+
+// Bot metrics, exported by the metrics package
+var (
+	connectedGauge = metrics.NewGauge("nyb_irc_connected",
+		"Whether the bot is registered on the irc server", "server", "nick")
+	reconnectsCounter = metrics.NewCounter("nyb_irc_reconnects_total",
+		"Number of reconnects to the irc server", "server", "nick")
+	messagesCounter = metrics.NewCounter("nyb_messages_sent_total",
+		"Messages sent by the bot per channel, private replies are counted as 'private'", "server", "channel")
+	commandsCounter = metrics.NewCounter("nyb_commands_total",
+		"Commands handled by type", "command")
+	geocoderLatency = metrics.NewHistogram("nyb_geocoder_request_seconds",
+		"Latency of the nominatim requests",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10})
+	geocoderErrors = metrics.NewCounter("nyb_geocoder_errors_total",
+		"Failed nominatim requests")
+	geocoderCacheHits = metrics.NewCounter("nyb_geocoder_cache_hits_total",
+		"Nominatim queries answered from the cache")
+	zonesCounter = metrics.NewCounter("nyb_zones_announced_total",
+		"Time zones announced", "server")
+	latenessHistogram = metrics.NewHistogram("nyb_announcement_lateness_seconds",
+		"Announcement send time minus the midnight in the zone",
+		[]float64{0.1, 0.25, 0.5, 1, 2, 5, 10, 30, 60, 300}, "server")
+	deliveryHistogram = metrics.NewHistogram("nyb_announcement_delivery_lateness_seconds",
+		"Server time of the echoed announcement minus the midnight in the zone",
+		[]float64{0.1, 0.25, 0.5, 1, 2, 5, 10, 30, 60, 300}, "server")
+	undeliveredCounter = metrics.NewCounter("nyb_announcements_undelivered_total",
+		"Announcements the server rejected or didn't echo back", "server")
+	panicsCounter = metrics.NewCounter("nyb_panics_total",
+		"Recovered panics", "server", "nick")
+	botsRunning = metrics.NewGauge("nyb_bot_running",
+		"Whether the supervised bot is running", "name")
+	geocoderWait = metrics.NewHistogram("nyb_geocoder_rate_limit_wait_seconds",
+		"Time the nominatim requests waited for the shared rate limiter",
+		[]float64{0.1, 0.25, 0.5, 1, 2, 5, 10})
+)
@@ -0,0 +1,102 @@
+package nyb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	kitty "github.com/ugjka/kittybot"
+)
+
+// Users mentioned in an announcement at most, the rest are counted,
+// the mentions also fit in a quarter of the announcement's first line
+const mentionCap = 10
+
+// notify subscribes the user to a mention at the saved location's midnight,
+// in the channel's announcement or privately when asked privately, "off" unsubscribes
+func (bot *Settings) notify(m *kitty.Message, arg string) {
+	channel, private := "", true
+	for _, ch := range bot.irc.Channels {
+		if channelKey(ch) == channelKey(m.To) {
+			channel, private = channelKey(ch), false
+		}
+	}
+	u := &bot.users
+	u.Lock()
+	s := u.saved[userKey(m)]
+	var text string
+	switch {
+	case s == nil:
+		text = fmt.Sprintf("Save your location first with %ssetlocation <place>", bot.Prefix)
+	case strings.EqualFold(arg, "off"):
+		s.Notify, s.Channel = false, ""
+		bot.saveUsers()
+		text = "You won't be notified"
+	case private:
+		s.Nick, s.Notify, s.Channel = m.Name, true, ""
+		bot.saveUsers()
+		text = fmt.Sprintf("I'll message you when New Year arrives in %s, %snotifyme off to stop", s.Place, bot.Prefix)
+	default:
+		s.Nick, s.Notify, s.Channel = m.Name, true, channel
+		bot.saveUsers()
+		text = fmt.Sprintf("You'll be mentioned here when New Year arrives in %s, %snotifyme off to stop", s.Place, bot.Prefix)
+	}
+	u.Unlock()
+	bot.reply(m, text)
+}
+
+// subscribers returns the users subscribed in the channel whose zone reaches midnight, by nick,
+// an empty channel gives the private subscribers
+func (bot *Settings) subscribers(ch string, zone TZ) []user {
+	var subs []user
+	u := &bot.users
+	u.Lock()
+	defer u.Unlock()
+	for _, s := range u.saved {
+		if !s.Notify || s.Channel != channelKey(ch) {
+			continue
+		}
+		loc, err := loadZone(s.Zone)
+		if err != nil || zoneOffset(bot.target, loc).Hours() != zone.Offset {
+			continue
+		}
+		subs = append(subs, *s)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Nick < subs[j].Nick })
+	return subs
+}
+
+// mentions prefixes the channel's announcement with the subscribers' nicks,
+// up to mentionCap nicks within size bytes
+func (bot *Settings) mentions(ch string, zone TZ, size int) string {
+	var nicks []string
+	for _, s := range bot.subscribers(ch, zone) {
+		nicks = append(nicks, s.Nick)
+	}
+	n := len(nicks)
+	if n > mentionCap {
+		n = mentionCap
+	}
+	for ; n > 0; n-- {
+		text := strings.Join(nicks[:n], ", ") + ": "
+		if more := len(nicks) - n; more > 0 {
+			text = strings.Join(nicks[:n], ", ") + fmt.Sprintf(" and %d more: ", more)
+		}
+		if len(text) <= size {
+			return text
+		}
+	}
+	return ""
+}
+
+// notifyPrivately messages the private subscribers whose zone reaches midnight,
+// spaced out by the limiter, the next zone waits for them
+func (bot *Settings) notifyPrivately(zone TZ) {
+	subs := bot.subscribers("", zone)
+	for _, s := range subs {
+		bot.send(s.Nick, bot.col("Happy New Year")+" in "+s.Place, nil, nil)
+	}
+	if len(subs) > 0 {
+		bot.schedLog.Info("notified users privately", "offset", zone.Offset, "users", len(subs))
+	}
+}
@@ -0,0 +1,79 @@
+package nyb
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMentions(t *testing.T) {
+	bot := &Settings{}
+	bot.target = time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+	bot.users.saved = map[string]*user{
+		"riga":    {Nick: "riga", Zone: "Europe/Riga", Notify: true, Channel: "#test"},
+		"private": {Nick: "private", Zone: "UTC+2", Notify: true},
+		"other":   {Nick: "other", Zone: "UTC+2", Notify: true, Channel: "#other"},
+		"quiet":   {Nick: "quiet", Zone: "UTC+2", Channel: "#test"},
+		"kiev":    {Nick: "Kiev", Zone: "Europe/Kiev", Notify: true, Channel: "#test"},
+		"paris":   {Nick: "paris", Zone: "Europe/Paris", Notify: true, Channel: "#test"},
+	}
+	zone := TZ{Offset: 2}
+	if got := bot.mentions("#TEST", zone, 400); got != "Kiev, riga: " {
+		t.Errorf("expected the #test subscribers; got %q", got)
+	}
+	if got := bot.subscribers("", zone); len(got) != 1 || got[0].Nick != "private" {
+		t.Errorf("expected the private subscriber; got %v", got)
+	}
+	if got := bot.mentions("#test", TZ{Offset: 3}, 400); got != "" {
+		t.Errorf("expected no mentions; got %q", got)
+	}
+	for i := 0; i < mentionCap+3; i++ {
+		nick := fmt.Sprintf("user%02d", i)
+		bot.users.saved[nick] = &user{Nick: nick, Zone: "UTC+1", Notify: true, Channel: "#test"}
+	}
+	const capped = "paris, user00, user01, user02, user03, user04, user05, user06, user07, user08 and 4 more: "
+	if got := bot.mentions("#test", TZ{Offset: 1}, 400); got != capped {
+		t.Errorf("expected %q; got %q", capped, got)
+	}
+	const budget = "paris, user00, user01 and 11 more: "
+	if got := bot.mentions("#test", TZ{Offset: 1}, len(budget)); got != budget {
+		t.Errorf("expected %q; got %q", budget, got)
+	}
+	if got := bot.mentions("#test", TZ{Offset: 1}, 5); got != "" {
+		t.Errorf("expected no room for mentions; got %q", got)
+	}
+}
+
+// The mentions of long nicks leave less of the first line than the first country of UTC-3:30
+func TestMentionsLongNicks(t *testing.T) {
+	bot := &Settings{}
+	bot.target = time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+	bot.users.saved = make(map[string]*user)
+	for i := 0; i < mentionCap; i++ {
+		nick := fmt.Sprintf("%s%02d", strings.Repeat("n", 28), i)
+		bot.users.saved[nick] = &user{Nick: nick, Zone: "UTC-3:30", Notify: true, Channel: "#test"}
+	}
+	var zone TZ
+	for _, z := range goldenZones(t) {
+		if z.Offset == -3.5 {
+			zone = z
+		}
+	}
+	const size = 400
+	happy := "Happy New Year in "
+	max := size - len(happy)
+	mention := bot.mentions("#test", zone, max/4)
+	if mention == "" || len(mention) > max/4 {
+		t.Fatalf("expected mentions within %d bytes; got %q", max/4, mention)
+	}
+	lines := strings.Split(mention+happy+zone.format(max-len(mention), max, false), "\n")
+	if !strings.HasPrefix(lines[0], mention+happy+zone.Countries[0].Name) || len(lines[0]) > size {
+		t.Errorf("unexpected first line: %q", lines[0])
+	}
+
+	// A country longer than the line isn't split off an empty line
+	if got := zone.Format(10, false); strings.HasPrefix(got, "\n") || !strings.HasPrefix(got, zone.Countries[0].Name) {
+		t.Errorf("unexpected lines: %q", got)
+	}
+}
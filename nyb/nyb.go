@@ -3,18 +3,27 @@ package nyb
 import (
 	"encoding/json"
 	"fmt"
+	"net"
+	"net/http"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	kitty "github.com/ugjka/kittybot"
+	"github.com/ugjka/newyearsbot/audit"
+	"github.com/ugjka/newyearsbot/nyb/clock"
 	log "gopkg.in/inconshreveable/log15.v2"
 )
 
 // Settings for the bot
 type Settings struct {
-	Nick      string
-	Channels  []string
-	Server    string
+	Nick     string
+	Channels []string
+	Server   string
+	// Servers to try when the main server is unreachable
+	Fallbacks []string
 	SSL       bool
 	Password  string
 	Prefix    string
@@ -22,6 +31,25 @@ type Settings struct {
 	Nominatim string
 	Limit     bool
 	Colors    bool
+	// SASL, NickServ and client certificate authentication
+	Auth Auth
+	// TLS certificate verification
+	TLS TLS
+	// Proxy for irc and geocoding: socks5://[user:pass@]host:port or http://[user:pass@]host:port
+	Proxy string
+	// Optional announcement audit log
+	Audit *audit.Log
+	// Optional state file, remembers the announced zones between restarts
+	State string
+	// Optional file to remember the users' locations
+	Users string
+	// Command aliases and the commands disabled per channel
+	Commands Commands
+	// Time source, defaults to the system clock
+	Clock clock.Clock
+	// Time source of the users' timeouts, the choice window and the schedule cooldown,
+	// real time even when Clock is simulated, defaults to the system clock
+	RealClock clock.Clock
 	irc       *kitty.Bot
 	extra
 }
@@ -32,57 +60,150 @@ type extra struct {
 	next      TZ
 	remaining int
 	first     bool
+	// Post the away summary before the next zone
+	restarted bool
+	state     state
 	target    time.Time
+	geoLog    log.Logger
+	schedLog  log.Logger
+	// http client for the geocoder, uses the proxy
+	http      *http.Client
+	v3        ircv3
+	sendMu    sync.Mutex
+	limiter   *limiter
+	reconnect reconnect
+	connected int32
+	// The server of the connection, the main one or a fallback
+	host       atomic.Value
+	saslFail   int32
+	identified int32
+	// Closed by Stop
+	quit     chan struct{}
+	stopOnce sync.Once
+	// The current irc connection
+	conn      net.Conn
+	connMu    sync.Mutex
+	panics    int32
+	lastPanic atomic.Value
+	// Places offered to the users for an ambiguous location
+	choices choices
+	// Schedules paged through by the users
+	schedules schedules
+	// Saved locations of the users
+	users users
+	// Commands by name and alias
+	router *router
 }
 
 // New creates a new bot
 func New(s *Settings) *Settings {
+	if s.Clock == nil {
+		s.Clock = clock.Real{}
+	}
+	if s.RealClock == nil {
+		s.RealClock = clock.Real{}
+	}
 	s.irc = kitty.NewBot(s.Server, s.Nick,
 		func(irc *kitty.Bot) {
 			irc.Channels = s.Channels
 			irc.Password = s.Password
-			irc.SSL = s.SSL
-			irc.LimitReplies = s.Limit
+			// TLS is done in dial
+			irc.SSL = false
+			irc.Dial = s.dial
+			// All the messages go through the bot's limiter
+			irc.LimitReplies = false
+			switch s.Auth.Mode {
+			case AuthPass:
+				irc.Password = s.Auth.Password
+			case AuthSASL, AuthExternal:
+				irc.SASL = true
+				irc.Password = s.Auth.Password
+			}
 		})
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxyFunc(s.Proxy)
+	s.http = &http.Client{Transport: transport}
+	root := log.New("nick", s.Nick, "server", s.Server)
+	s.irc.Logger = root.New("subsys", LogIRC)
+	s.geoLog = root.New("subsys", LogGeocoder)
+	s.schedLog = root.New("subsys", LogScheduler)
+	s.router = newRouter(s.Commands)
+	s.limiter = newLimiter(s.irc.ReplyMessageLimit, s.irc.ReplyInterval)
+	s.v3.reset()
+	s.quit = make(chan struct{})
+	s.LogLvl(log.LvlInfo)
 	return s
 }
 
-// LogLvl sets the log level
-func (bot *Settings) LogLvl(Lvl log.Lvl) {
-	logHandler := log.LvlFilterHandler(Lvl, log.StderrHandler)
-	bot.irc.Logger.SetHandler(logHandler)
-}
-
 // Start starts the bot
 func (bot *Settings) Start() {
-	bot.target = target
+	bot.target = newTarget(bot.now())
 	irc := bot.irc
-	irc.Info("Starting the bot...")
+	sched := bot.schedLog
+	bot.restarted = bot.loadState()
+	bot.first = bot.state.Help
+	bot.loadUsers()
+	sched.Info("starting the bot", "target", bot.target.Year(), "restarted", bot.restarted)
 
 	bot.addTriggers()
-	go bot.ircControl()
+	go func() {
+		// Let the supervisor restart the bot
+		defer func() {
+			if r := recover(); r != nil {
+				bot.panicked("irc", r)
+				bot.Stop()
+			}
+		}()
+		bot.ircControl()
+	}()
 
-	<-irc.Joined
+	select {
+	case <-irc.Joined:
+	case <-bot.quit:
+		return
+	}
 	// Neet to wait a bit for prefix
-	time.Sleep(time.Second * 5)
-	irc.Info("Got start...")
+	bot.Clock.Sleep(time.Second * 5)
+	sched.Info("joined, starting the zone loop")
 
 	if err := bot.decodeZones(Zones); err != nil {
-		irc.Crit("Decode zones error: " + err.Error())
+		sched.Crit("decode zones", "error", err)
 		return
 	}
 	for {
 		bot.loopTimeZones()
-		var zonesFinishedMsg = bot.col("That's it") + ", Year " +
-			bot.col("%d") + " is here " +
-			bot.col("Anywhere on Earth")
-		for _, ch := range irc.Channels {
-			irc.Msg(ch, fmt.Sprintf(zonesFinishedMsg, bot.target.Year()))
+		if bot.stopped() {
+			sched.Info("stopped")
+			return
 		}
-		irc.Info("All zones finished...")
-		bot.target = bot.target.AddDate(1, 0, 0)
-		irc.Info(fmt.Sprintf("Wrapping the target date around to %d", bot.target.Year()))
+		bot.wrapYear()
+	}
+}
+
+// wrapYear announces the end of the year and moves the target to the next year
+func (bot *Settings) wrapYear() {
+	var zonesFinishedMsg = bot.col("That's it") + ", Year " +
+		bot.col("%d") + " is here " +
+		bot.col("Anywhere on Earth")
+	for _, ch := range bot.irc.Channels {
+		bot.msg(ch, fmt.Sprintf(zonesFinishedMsg, bot.target.Year()))
 	}
+	bot.schedLog.Info("all zones finished", "year", bot.target.Year())
+	bot.target = bot.target.AddDate(1, 0, 0)
+	bot.saveState(func(st *state) {
+		st.Target = bot.target.Year()
+		st.Announced = make(map[string]float64)
+	})
+	bot.schedLog.Info("wrapping the target date around", "target", bot.target.Year())
+}
+
+func (bot *Settings) now() time.Time {
+	return bot.Clock.Now()
+}
+
+// realNow is the time of the users' timeouts, which don't speed up with a simulated clock
+func (bot *Settings) realNow() time.Time {
+	return bot.RealClock.Now()
 }
 
 func (bot *Settings) decodeZones(z []byte) error {
@@ -93,20 +214,92 @@ func (bot *Settings) decodeZones(z []byte) error {
 	return nil
 }
 
-const reconnectInterval = time.Second * 30
+func (bot *Settings) setConnected(connected bool) {
+	if connected {
+		atomic.StoreInt32(&bot.connected, 1)
+		connectedGauge.Set(1, bot.server(), bot.Nick)
+		return
+	}
+	atomic.StoreInt32(&bot.connected, 0)
+	atomic.StoreInt32(&bot.saslFail, 0)
+	atomic.StoreInt32(&bot.identified, 0)
+	connectedGauge.Set(0, bot.server(), bot.Nick)
+}
+
+// server is the server the bot connects to, the main one or a fallback
+func (bot *Settings) server() string {
+	if host, ok := bot.host.Load().(string); ok {
+		return host
+	}
+	return bot.Server
+}
 
-func (bot *Settings) ircControl() {
-	irc := bot.irc
-	for {
-		irc.Run()
-		irc.Info("Reconnecting...")
-		time.Sleep(reconnectInterval)
+func (bot *Settings) isConnected() bool {
+	return atomic.LoadInt32(&bot.connected) == 1
+}
+
+// audit writes an announcement record to the audit log
+func (bot *Settings) audit(r audit.Record) {
+	if bot.Audit == nil {
+		return
+	}
+	r.Server = bot.server()
+	r.Nick = bot.Nick
+	if r.Target == 0 {
+		r.Target = bot.target.Year()
+	}
+	if err := bot.Audit.Write(r); err != nil {
+		bot.schedLog.Error("audit log", "error", err)
+	}
+}
+
+// msg sends a message to a channel and counts it
+func (bot *Settings) msg(ch, text string) {
+	messagesCounter.Inc(bot.server(), channelKey(ch))
+	bot.send(channelName(ch), text, nil, nil)
+}
+
+// announce sends a new year announcement, it's confirmed by the server's echo
+func (bot *Settings) announce(ch, text string, rec audit.Record) {
+	messagesCounter.Inc(bot.server(), channelKey(ch))
+	bot.send(channelName(ch), text, nil, &rec)
+}
+
+// reply replies to a message and counts it,
+// the reply is threaded to the message if the server supports message tags
+func (bot *Settings) reply(m *kitty.Message, text string) {
+	ch := m.To
+	if !strings.HasPrefix(ch, "#") && !strings.HasPrefix(ch, "&") {
+		ch = "private"
+	}
+	messagesCounter.Inc(bot.server(), channelKey(ch))
+	// The replies are dropped rather than waiting for the limiter
+	if bot.Limit && !bot.limiter.take(len(splitLines(text, bot.irc.ReplyMaxSize(m)))) {
+		bot.irc.Warn("reply-limiter", "dropped", text)
+		return
+	}
+	bot.write(replyTarget(m), text, bot.replyTags(m), nil)
+}
+
+// replyTarget is kittybot's reply target
+func replyTarget(m *kitty.Message) string {
+	if strings.Contains(m.To, "#") {
+		return m.To
 	}
+	return m.Name
 }
 
 func (bot *Settings) loopTimeZones() {
 	zones := bot.zones
 	irc := bot.irc
+	// Zones that passed before the bot started
+	var passed TZS
+	defer func() {
+		if bot.restarted && !bot.stopped() {
+			bot.restarted = false
+			bot.awaySummary(passed)
+		}
+	}()
 	for i := 0; i < len(zones); i++ {
 		dur := time.Minute * time.Duration(zones[i].Offset*60)
 		bot.next = zones[i]
@@ -116,44 +309,90 @@ func (bot *Settings) loopTimeZones() {
 			bot.previous = zones[i-1]
 		}
 		bot.remaining = len(zones) - i
-		if now().UTC().Add(dur).Before(bot.target) {
-			time.Sleep(time.Second * 2)
-			irc.Info(fmt.Sprintf("Zone pending: %.2f", zones[i].Offset))
-			hdur := humanDur(bot.target.Sub(now().UTC().Add(dur)))
+		if bot.now().UTC().Add(dur).Before(bot.target) {
+			if bot.restarted {
+				bot.restarted = false
+				bot.awaySummary(passed)
+			}
+			bot.Clock.Sleep(time.Second * 2)
+			bot.schedLog.Info("zone pending", "offset", zones[i].Offset,
+				"in", bot.target.Sub(bot.now().UTC().Add(dur)))
+			midnight := bot.target.Add(-dur)
+			for _, ch := range irc.Channels {
+				bot.audit(audit.Record{
+					Event:     audit.Scheduled,
+					Channel:   channelKey(ch),
+					Offset:    zones[i].Offset,
+					Scheduled: midnight,
+				})
+			}
+			hdur := humanDur(bot.target.Sub(bot.now().UTC().Add(dur)))
 			hdur = bot.col(hdur)
 			next := bot.col("Next New Year") + " in "
-			if i == 0 && !(now().Month() == time.January && now().Day() < 2) {
+			if i == 0 && !(bot.now().Month() == time.January && bot.now().Day() < 2) {
 				next = bot.col("First New Year") + " in "
 			}
 			if i == len(zones)-1 {
 				next = bot.col("Final New Year") + " in "
 			}
-			help := fmt.Sprintf(helpMsg, bot.Prefix, bot.Prefix, bot.Prefix, bot.Prefix, bot.Prefix, bot.Prefix, bot.Prefix)
 			for _, ch := range irc.Channels {
-				max := irc.MsgMaxSize(ch)
+				max := irc.MsgMaxSize(channelName(ch))
 				max -= len(next)
 				max -= len(hdur)
 				max -= 4
 				if !bot.first {
-					irc.Msg(ch, next+hdur+" in "+zones[i].Format(max, bot.Colors))
-					irc.Msg(ch, help)
+					bot.msg(ch, next+hdur+" in "+zones[i].Format(max, bot.Colors))
+					bot.msg(ch, bot.help(ch))
 					bot.first = true
+					bot.saveState(func(st *state) { st.Help = true })
 				} else {
-					irc.Msg(ch, next+hdur+". "+
+					bot.msg(ch, next+hdur+". "+
 						fmt.Sprintf("See %snext or %shelp.", bot.Prefix, bot.Prefix))
 				}
 			}
 			//Wait till Target in Timezone
-			timer := NewTimer(bot.target.Sub(now().UTC().Add(dur)))
-			<-timer.C
+			timer := bot.Clock.NewTimer(bot.target.Sub(bot.now().UTC().Add(dur)))
+			select {
+			case <-timer.C:
+			case <-bot.quit:
+				timer.Stop()
+				return
+			}
 			timer.Stop()
 			var happy = bot.col("Happy New Year") + " in "
 			for _, ch := range irc.Channels {
-				max := irc.MsgMaxSize(ch)
+				max := irc.MsgMaxSize(channelName(ch))
 				max -= len(happy)
-				irc.Msg(ch, happy+zones[i].Format(max, bot.Colors))
+				mention := bot.mentions(ch, zones[i], max/4)
+				rec := audit.Record{
+					Event:     audit.Sent,
+					Channel:   channelKey(ch),
+					Offset:    zones[i].Offset,
+					Scheduled: midnight,
+				}
+				rec.Target = bot.target.Year()
+				if !bot.isConnected() {
+					rec.Error = "not connected"
+					bot.audit(rec)
+					bot.miss(ch, zones[i], rec)
+					bot.schedLog.Warn("zone missed, announcing when reconnected", "offset", zones[i].Offset,
+						"channel", ch)
+					continue
+				}
+				rec.Sent = bot.now().UTC()
+				// Only the first line carries the mentions
+				bot.announce(ch, mention+happy+zones[i].format(max-len(mention), max, bot.Colors), rec)
+				bot.audit(rec)
+				bot.setAnnounced(ch, zones[i].Offset)
+				lateness := rec.Sent.Sub(midnight)
+				latenessHistogram.Observe(lateness.Seconds(), bot.server())
+				bot.schedLog.Info("announced zone", "offset", zones[i].Offset,
+					"channel", ch, "lateness", lateness, "host", bot.server())
 			}
-			irc.Info(fmt.Sprintf("Announcing zone: %.2f", zones[i].Offset))
+			bot.notifyPrivately(zones[i])
+			zonesCounter.Inc(bot.server())
+		} else {
+			passed = append(passed, zones[i])
 		}
 	}
 }
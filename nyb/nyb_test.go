@@ -0,0 +1,182 @@
+package nyb
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	kitty "github.com/ugjka/kittybot"
+	"github.com/ugjka/newyearsbot/nyb/clock"
+	"github.com/ugjka/newyearsbot/nyb/clock/clocktest"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// testBot returns a bot connected to a pipe,
+// the messages it sends to #test are delivered on the returned channel
+func testBot(t *testing.T, nick string, clk clock.Clock) (*Settings, <-chan string) {
+	bot := New(&Settings{
+		Nick:     nick,
+		Channels: []string{"#test"},
+		Server:   "irc.test:6667",
+		Prefix:   "!",
+		Clock:    clk,
+	})
+	bot.LogLvl(log.LvlCrit)
+	if err := bot.decodeZones(Zones); err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	bot.irc.ThrottleDelay = 0
+	bot.irc.Dial = func(network, addr string) (net.Conn, error) {
+		return client, nil
+	}
+	lines := make(chan string, 1024)
+	go func() {
+		scan := bufio.NewScanner(server)
+		for scan.Scan() {
+			const prefix = "PRIVMSG #test :"
+			if strings.HasPrefix(scan.Text(), prefix) {
+				lines <- strings.TrimPrefix(scan.Text(), prefix)
+			}
+		}
+	}()
+	go bot.irc.Run()
+	bot.setConnected(true)
+	t.Cleanup(func() {
+		server.Close()
+	})
+	return bot, lines
+}
+
+// collect sends a marker message and returns all the lines sent before it
+func collect(t *testing.T, bot *Settings, lines <-chan string) []string {
+	const marker = "--marker--"
+	bot.msg("#test", marker)
+	var res []string
+	for {
+		select {
+		case line := <-lines:
+			if line == marker {
+				return res
+			}
+			res = append(res, line)
+		case <-time.After(time.Second * 10):
+			t.Fatalf("timed out, got: %q", res)
+		}
+	}
+}
+
+func countPrefix(lines []string, prefix string) (n int) {
+	for _, line := range lines {
+		if strings.HasPrefix(line, prefix) {
+			n++
+		}
+	}
+	return
+}
+
+func TestLoopTimeZones(t *testing.T) {
+	clk := clocktest.New(time.Date(2024, time.December, 31, 9, 0, 0, 0, time.UTC))
+	clk.Auto = true
+	bot, lines := testBot(t, "looptest", clk)
+	bot.target = newTarget(clk.Now())
+
+	bot.loopTimeZones()
+	got := collect(t, bot, lines)
+
+	const first = "First New Year in 59 minutes 58 seconds in Kiribati (Kiritimati, Line Islands)"
+	if got[0] != first {
+		t.Errorf("expected %q; got %q", first, got[0])
+	}
+	if got[1] != bot.help("#test") {
+		t.Errorf("expected help; got %q", got[1])
+	}
+	if n := countPrefix(got, "Happy New Year in "); n != len(bot.zones) {
+		t.Errorf("expected %d announcements; got %d", len(bot.zones), n)
+	}
+	if n := countPrefix(got, "Next New Year in "); n != len(bot.zones)-2 {
+		t.Errorf("expected %d next messages; got %d", len(bot.zones)-2, n)
+	}
+	if n := countPrefix(got, "Final New Year in "); n != 1 {
+		t.Errorf("expected 1 final message; got %d", n)
+	}
+	const next = "Next New Year in 14 minutes 58 seconds. See !next or !help."
+	if got[3] != next {
+		t.Errorf("expected %q; got %q", next, got[3])
+	}
+	if bot.remaining != 1 || bot.next.Offset != -12 {
+		t.Errorf("unexpected state after the loop: remaining %d, next %v", bot.remaining, bot.next.Offset)
+	}
+}
+
+func TestWrapYear(t *testing.T) {
+	clk := clocktest.New(time.Date(2025, time.January, 1, 12, 0, 1, 0, time.UTC))
+	clk.Auto = true
+	bot, lines := testBot(t, "wraptest", clk)
+	bot.target = newTarget(clk.Now())
+	bot.first = true
+
+	bot.wrapYear()
+	if bot.target.Year() != 2026 {
+		t.Errorf("expected target 2026; got %d", bot.target.Year())
+	}
+	got := collect(t, bot, lines)
+	const finished = "That's it, Year 2025 is here Anywhere on Earth"
+	if len(got) != 1 || got[0] != finished {
+		t.Errorf("expected %q; got %q", finished, got)
+	}
+
+	// Second year, starting an hour before the UTC+1 new year
+	clk.Set(time.Date(2025, time.December, 31, 22, 0, 0, 0, time.UTC))
+	bot.loopTimeZones()
+	got = collect(t, bot, lines)
+	var pending int
+	for _, zone := range bot.zones {
+		if zone.Offset < 2 {
+			pending++
+		}
+	}
+	if n := countPrefix(got, "Happy New Year in "); n != pending {
+		t.Errorf("expected %d announcements; got %d", pending, n)
+	}
+	if !strings.HasPrefix(got[0], "Next New Year in 59 minutes 58 seconds.") {
+		t.Errorf("unexpected first message: %q", got[0])
+	}
+	if countPrefix(got, "First New Year") != 0 || countPrefix(got, "Commands:") != 0 {
+		t.Error("repeated the first new year message")
+	}
+}
+
+func TestLateStart(t *testing.T) {
+	clk := clocktest.New(time.Date(2025, time.January, 1, 5, 0, 0, 0, time.UTC))
+	clk.Auto = true
+	bot, lines := testBot(t, "latetest", clk)
+	bot.target = newTarget(clk.Now())
+	if bot.target.Year() != 2025 {
+		t.Fatalf("expected target 2025; got %d", bot.target.Year())
+	}
+
+	bot.loopTimeZones()
+	got := collect(t, bot, lines)
+	if !strings.HasPrefix(got[0], "Next New Year in 59 minutes 58 seconds in ") {
+		t.Errorf("unexpected first message: %q", got[0])
+	}
+	if n := countPrefix(got, "Commands:"); n != 1 {
+		t.Errorf("expected the help once; got %d", n)
+	}
+}
+
+func TestTriggerPanic(t *testing.T) {
+	bot := New(&Settings{Nick: "panicky", Server: "irc.test:6667", Clock: clock.Real{}})
+	bot.setHandlers(log.DiscardHandler(), func(string) log.Lvl { return log.LvlCrit })
+	trigger := safeTrigger{Trigger: kitty.Trigger{
+		Condition: func(*kitty.Bot, *kitty.Message) bool { return true },
+		Action:    func(*kitty.Bot, *kitty.Message) { panic("trigger boom") },
+	}, bot: bot}
+	trigger.Handle(bot.irc, &kitty.Message{})
+	if bot.panics != 1 || bot.lastPanic.Load() != "trigger boom" {
+		t.Errorf("expected a recovered panic; got %d %v", bot.panics, bot.lastPanic.Load())
+	}
+}
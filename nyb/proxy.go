@@ -0,0 +1,281 @@
+package nyb
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CheckProxy validates the proxy url for the irc server:
+// socks5://[user:pass@]host:port or http://[user:pass@]host:port,
+// .onion servers need a socks5 proxy such as Tor
+func CheckProxy(proxy, server string) error {
+	if proxy == "" {
+		if isOnion(server) {
+			return errors.New("onion servers need a socks5 proxy")
+		}
+		return nil
+	}
+	u, err := parseProxy(proxy)
+	if err != nil {
+		return err
+	}
+	if isOnion(server) && u.Scheme == "http" {
+		return errors.New("onion servers need a socks5 proxy")
+	}
+	return nil
+}
+
+func parseProxy(proxy string) (*url.URL, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url: %v", err)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %s", u.Scheme)
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return nil, fmt.Errorf("proxy url needs a host and a port: %s", proxy)
+	}
+	return u, nil
+}
+
+// proxyDial connects to addr through the proxy,
+// host names are resolved by the proxy, so .onion addresses work with Tor
+func proxyDial(proxy, addr string) (net.Conn, error) {
+	u, err := parseProxy(proxy)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := net.DialTimeout("tcp", u.Host, dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: %v", err)
+	}
+	raw.SetDeadline(time.Now().Add(dialTimeout))
+	conn := raw
+	if u.Scheme == "http" {
+		conn, err = httpConnect(raw, u, addr)
+	} else {
+		err = socks5Connect(raw, u, addr)
+	}
+	if err != nil {
+		raw.Close()
+		return nil, fmt.Errorf("proxy: %v", err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// proxyFunc returns the proxy for the geocoder's http client,
+// without a proxy the environment's HTTP_PROXY and friends are used as before
+func proxyFunc(proxy string) func(*http.Request) (*url.URL, error) {
+	if proxy == "" {
+		return http.ProxyFromEnvironment
+	}
+	return func(*http.Request) (*url.URL, error) {
+		u, err := parseProxy(proxy)
+		if err != nil {
+			return nil, err
+		}
+		// net/http resolves the host names on the proxy for socks5 too
+		if u.Scheme == "socks5h" {
+			v := *u
+			v.Scheme = "socks5"
+			u = &v
+		}
+		return u, nil
+	}
+}
+
+func httpConnect(conn net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		pass, _ := proxy.User.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		return nil, fmt.Errorf("http authentication failed: %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("connect %s: %s", addr, resp.Status)
+	}
+	// The server might have talked already
+	if r.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: r}, nil
+	}
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// SOCKS5, RFC 1928 and RFC 1929
+const (
+	socksVersion     = 5
+	socksNoAuth      = 0
+	socksUserPass    = 2
+	socksNoMethods   = 0xff
+	socksConnect     = 1
+	socksIPv4        = 1
+	socksDomain      = 3
+	socksIPv6        = 4
+	socksAuthVersion = 1
+)
+
+var socksErrors = []string{
+	"",
+	"general failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"ttl expired",
+	"command not supported",
+	"address type not supported",
+}
+
+func socks5Connect(conn net.Conn, proxy *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 0xffff {
+		return fmt.Errorf("invalid port: %s", portStr)
+	}
+
+	methods := []byte{socksNoAuth}
+	if proxy.User != nil {
+		methods = []byte{socksUserPass}
+	}
+	greeting := append([]byte{socksVersion, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if buf[0] != socksVersion {
+		return fmt.Errorf("not a socks5 proxy")
+	}
+	switch buf[1] {
+	case socksNoAuth:
+	case socksUserPass:
+		if proxy.User == nil {
+			return errors.New("socks5 proxy wants a username and password")
+		}
+		user := proxy.User.Username()
+		pass, _ := proxy.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return errors.New("socks5 username or password too long")
+		}
+		req := []byte{socksAuthVersion, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return err
+		}
+		if buf[1] != 0 {
+			return errors.New("socks5 authentication failed")
+		}
+	case socksNoMethods:
+		return errors.New("socks5 proxy refused the authentication methods")
+	default:
+		return fmt.Errorf("socks5 proxy chose an unknown authentication method: %d", buf[1])
+	}
+
+	req := []byte{socksVersion, socksConnect, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, socksIPv4)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, socksIPv6)
+			req = append(req, ip...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long: %s", host)
+		}
+		req = append(req, socksDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if code := int(head[1]); code != 0 {
+		msg := "unknown error"
+		if code < len(socksErrors) {
+			msg = socksErrors[code]
+		}
+		return fmt.Errorf("connect %s: %s", addr, msg)
+	}
+	// Skip the bound address
+	var skip int
+	switch head[3] {
+	case socksIPv4:
+		skip = net.IPv4len
+	case socksIPv6:
+		skip = net.IPv6len
+	case socksDomain:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		skip = int(buf[0])
+	default:
+		return fmt.Errorf("socks5 proxy sent an unknown address type: %d", head[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+// isOnion reports whether the server is a Tor hidden service
+func isOnion(server string) bool {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		host = server
+	}
+	return strings.HasSuffix(strings.ToLower(host), ".onion")
+}
@@ -0,0 +1,178 @@
+package nyb
+
+import (
+	"math/rand"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ugjka/ircmsg"
+	"github.com/ugjka/newyearsbot/audit"
+)
+
+// Reconnect backoff, doubled after each failed connection
+const (
+	reconnectMin = time.Second * 2
+	reconnectMax = time.Minute * 2
+)
+
+// Zones missed while disconnected are announced late within this window
+const catchUpWindow = time.Hour * 6
+
+// ERROR messages of K-lines and other bans
+var banReg = regexp.MustCompile(`(?i)\b([kgzd]-?lined|banned)\b`)
+
+// reconnect is the reconnect state shared by the connection and the scheduler
+type reconnect struct {
+	// Servers the bot is banned from
+	banned map[string]string
+	// Zones that passed while disconnected, per channel
+	missed map[string][]missedZone
+	sync.Mutex
+}
+
+type missedZone struct {
+	channel string
+	zone    TZ
+	rec     audit.Record
+}
+
+// servers returns the main server followed by the fallbacks
+func (bot *Settings) servers() []string {
+	return append([]string{bot.Server}, bot.Fallbacks...)
+}
+
+// ircControl keeps the bot connected, rotating through the servers with
+// exponential backoff, and gives up when banned from all of them
+func (bot *Settings) ircControl() {
+	irc := bot.irc
+	servers := bot.servers()
+	backoff := reconnectMin
+	i := 0
+	for {
+		irc.Host = servers[i]
+		bot.host.Store(servers[i])
+		irc.Run()
+		registered := bot.isConnected()
+		bot.setConnected(false)
+		if bot.stopped() {
+			return
+		}
+		if reason, ok := bot.isBanned(servers[i]); ok {
+			irc.Crit("banned from the server", "host", servers[i], "reason", reason)
+		}
+		next := bot.nextServer(servers, i)
+		if next < 0 {
+			irc.Crit("banned from all the servers, not reconnecting")
+			return
+		}
+		if registered {
+			// Retry the same server after a working connection
+			backoff = reconnectMin
+			if _, ok := bot.isBanned(servers[i]); ok {
+				i = next
+			}
+		} else {
+			i = next
+			if backoff *= 2; backoff > reconnectMax {
+				backoff = reconnectMax
+			}
+		}
+		delay := jitter(backoff)
+		irc.Info("reconnecting", "host", servers[i], "in", delay)
+		select {
+		case <-time.After(delay):
+		case <-bot.quit:
+			return
+		}
+		reconnectsCounter.Inc(servers[i], bot.Nick)
+	}
+}
+
+// nextServer returns the index of the next server we are not banned from or -1
+func (bot *Settings) nextServer(servers []string, i int) int {
+	for n := 1; n <= len(servers); n++ {
+		j := (i + n) % len(servers)
+		if _, ok := bot.isBanned(servers[j]); !ok {
+			return j
+		}
+	}
+	return -1
+}
+
+// jitter returns a random delay between d/2 and d
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// checkBan detects K-lines and bans on the server
+func (bot *Settings) checkBan(server string, m *ircmsg.Message) {
+	switch {
+	case m.Command == "465":
+	case m.Command == "ERROR" && banReg.MatchString(m.Trailing()):
+	default:
+		return
+	}
+	bot.reconnect.Lock()
+	defer bot.reconnect.Unlock()
+	if bot.reconnect.banned == nil {
+		bot.reconnect.banned = make(map[string]string)
+	}
+	bot.reconnect.banned[server] = m.Trailing()
+}
+
+func (bot *Settings) isBanned(server string) (string, bool) {
+	bot.reconnect.Lock()
+	defer bot.reconnect.Unlock()
+	reason, ok := bot.reconnect.banned[server]
+	return reason, ok
+}
+
+func channelKey(ch string) string {
+	return strings.ToLower(channelName(ch))
+}
+
+// channelName strips the channel's key
+func channelName(ch string) string {
+	return strings.SplitN(ch, ":", 2)[0]
+}
+
+// miss remembers a zone that couldn't be announced
+func (bot *Settings) miss(ch string, zone TZ, rec audit.Record) {
+	bot.reconnect.Lock()
+	defer bot.reconnect.Unlock()
+	if bot.reconnect.missed == nil {
+		bot.reconnect.missed = make(map[string][]missedZone)
+	}
+	key := channelKey(ch)
+	bot.reconnect.missed[key] = append(bot.reconnect.missed[key], missedZone{ch, zone, rec})
+}
+
+// catchUp announces the zones missed in the channel with a (late) note
+func (bot *Settings) catchUp(ch string) {
+	bot.reconnect.Lock()
+	missed := bot.reconnect.missed[channelKey(ch)]
+	delete(bot.reconnect.missed, channelKey(ch))
+	bot.reconnect.Unlock()
+	var happy = bot.col("Happy New Year") + " in "
+	const late = " (late)"
+	for _, m := range missed {
+		rec := m.rec
+		if bot.now().Sub(rec.Scheduled) > catchUpWindow {
+			bot.schedLog.Info("too late to announce the missed zone", "offset", rec.Offset,
+				"channel", m.channel)
+			continue
+		}
+		max := bot.irc.MsgMaxSize(channelName(m.channel)) - len(happy) - len(late)
+		rec.Error = ""
+		rec.Sent = bot.now().UTC()
+		bot.announce(m.channel, happy+m.zone.Format(max, bot.Colors)+late, rec)
+		bot.audit(rec)
+		bot.setAnnounced(m.channel, m.zone.Offset)
+		lateness := rec.Sent.Sub(rec.Scheduled)
+		latenessHistogram.Observe(lateness.Seconds(), bot.server())
+		bot.schedLog.Info("announced missed zone", "offset", rec.Offset,
+			"channel", m.channel, "lateness", lateness)
+	}
+}
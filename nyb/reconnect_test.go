@@ -0,0 +1,108 @@
+package nyb_test
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ugjka/newyearsbot/audit"
+	"github.com/ugjka/newyearsbot/metrics"
+	"github.com/ugjka/newyearsbot/nyb"
+)
+
+// waitAudit polls the audit log until a record satisfies match
+func waitAudit(t *testing.T, file string, match func(audit.Record) bool) audit.Record {
+	t.Helper()
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond * 50)
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, err := audit.Read(strings.NewReader(string(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range records {
+			if match(r) {
+				return r
+			}
+		}
+	}
+	t.Fatal("no matching audit record")
+	return audit.Record{}
+}
+
+func TestE2EFallback(t *testing.T) {
+	t.Parallel()
+	main, fallback := newServer(t), newServer(t)
+	startBot(t, main, "e2efallback", eve, func(s *nyb.Settings) {
+		s.Fallbacks = []string{fallback.Addr()}
+	})
+	main.Close()
+	if err := fallback.WaitJoin(timeout, "e2efallback", "#test"); err != nil {
+		t.Fatal("bot didn't join the fallback server:", err)
+	}
+	// Labelled with the server the bot is connected to
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	connected := `nyb_irc_connected{server="` + fallback.Addr() + `",nick="e2efallback"} 1`
+	if body := rec.Body.String(); !strings.Contains(body, connected) {
+		t.Errorf("expected %s in the metrics:\n%s", connected, body)
+	}
+}
+
+func TestE2EBanned(t *testing.T) {
+	t.Parallel()
+	srv := newServer(t)
+	startBot(t, srv, "e2ebanned", eve)
+	srv.Ban("e2ebanned", "spam")
+	// Longer than the first reconnect delay
+	time.Sleep(reconnectWait)
+	if n := srv.Connections(); n != 1 {
+		t.Errorf("expected no reconnects after a ban; got %d connections", n)
+	}
+}
+
+const reconnectWait = time.Second * 3
+
+func TestE2ELateAnnouncement(t *testing.T) {
+	t.Parallel()
+	srv := newServer(t)
+	auditFile := filepath.Join(t.TempDir(), "audit.jsonl")
+	auditLog, err := audit.Open(auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := startBot(t, srv, "e2elate", eve, func(s *nyb.Settings) {
+		s.Audit = auditLog
+	})
+	e.expect("#test", "First New Year in 53 seconds in "+kiribati)
+	e.expect("#test", helpText)
+
+	// Kiribati passes while the bot can't register
+	srv.Hold(true)
+	srv.Disconnect(e.nick)
+	for deadline := time.Now().Add(timeout); srv.Connections() < 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("bot didn't reconnect")
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	e.clock.Advance(time.Minute)
+	missed := waitAudit(t, auditFile, func(r audit.Record) bool {
+		return r.Event == audit.Sent && r.Error == "not connected"
+	})
+	if missed.Offset != 14 || missed.Channel != "#test" {
+		t.Errorf("unexpected missed record: %+v", missed)
+	}
+
+	srv.Hold(false)
+	e.expect("#test", "Happy New Year in "+kiribati+" (late)")
+	waitAudit(t, auditFile, func(r audit.Record) bool {
+		return r.Offset == 14 && r.Error == "" && !r.Sent.IsZero()
+	})
+}
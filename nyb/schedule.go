@@ -0,0 +1,146 @@
+package nyb
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	kitty "github.com/ugjka/kittybot"
+	"github.com/ugjka/newyearsbot/audit"
+)
+
+const (
+	// Lines of a schedule page with the page footer,
+	// The limiter allows 5 lines per 10 seconds
+	schedulePage = 5
+	// A user can ask for a schedule page this often
+	scheduleCooldown = time.Second * 10
+)
+
+// schedules are the users' schedules being paged through, by nick
+type schedules struct {
+	users map[string]*schedule
+	sync.Mutex
+}
+
+type schedule struct {
+	pages [][]string
+	next  int
+	last  time.Time
+}
+
+// schedule sends the user a page of the remaining zones privately,
+// arg is "more" for the next page or an optional location for the user's local times,
+// the saved location without one
+func (bot *Settings) schedule(m *kitty.Message, arg string) {
+	user := strings.ToLower(m.Name)
+	now := bot.realNow()
+	dm := bot.private(m)
+	bot.schedules.Lock()
+	if bot.schedules.users == nil {
+		bot.schedules.users = make(map[string]*schedule)
+	}
+	s := bot.schedules.users[user]
+	if s != nil && now.Sub(s.last) < scheduleCooldown {
+		bot.schedules.Unlock()
+		wait := humanDur(s.last.Add(scheduleCooldown).Sub(now).Round(time.Second))
+		bot.reply(m, "Wait "+wait+" for the next schedule page")
+		return
+	}
+	if strings.EqualFold(arg, "more") {
+		if s == nil || s.next >= len(s.pages) {
+			bot.schedules.Unlock()
+			bot.reply(dm, "No more schedule pages, start over with "+bot.Prefix+"schedule")
+			return
+		}
+		page := s.pages[s.next]
+		s.next++
+		s.last = now
+		bot.schedules.Unlock()
+		bot.reply(dm, strings.Join(page, "\n"))
+		return
+	}
+	bot.schedules.Unlock()
+
+	var local *place
+	p, ok, err := bot.userPlace(m)
+	if err != nil {
+		bot.queryError(m, err)
+		return
+	}
+	if ok {
+		local = &p
+	}
+	pages := bot.schedulePages(local, bot.irc.ReplyMaxSize(dm))
+	if len(pages) == 0 {
+		bot.reply(dm, fmt.Sprintf("No more next, %d is here AoE", bot.target.Year()))
+		return
+	}
+	bot.schedules.Lock()
+	// Forget the old schedules
+	for nick, old := range bot.schedules.users {
+		if now.Sub(old.last) > choiceWindow {
+			delete(bot.schedules.users, nick)
+		}
+	}
+	bot.schedules.users[user] = &schedule{pages: pages, next: 1, last: now}
+	bot.schedules.Unlock()
+	bot.reply(dm, strings.Join(pages[0], "\n"))
+}
+
+// schedulePages pages the remaining zones with their UTC and local times
+func (bot *Settings) schedulePages(local *place, max int) [][]string {
+	var lines []string
+	for _, zone := range bot.zones {
+		if bot.untilMidnight(zone.Offset) <= 0 {
+			continue
+		}
+		midnight := bot.target.Add(-time.Minute * time.Duration(zone.Offset*60))
+		when := midnight.Format("Jan 2 15:04") + " UTC"
+		if local != nil {
+			when += " (" + midnight.In(local.zone).Format("Jan 2 15:04") + " your time)"
+		}
+		when += " " + audit.OffsetName(zone.Offset) + ": "
+		lines = append(lines, strings.Split(when+zone.Format(max-len(when), bot.Colors), "\n")...)
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	header := fmt.Sprintf("New Year %d schedule", bot.target.Year())
+	if local != nil {
+		header += " for " + local.name
+	}
+	lines = append([]string{header}, lines...)
+	size := schedulePage - 1
+	count := (len(lines) + size - 1) / size
+	var pages [][]string
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(lines) {
+			end = len(lines)
+		}
+		page := append([]string{}, lines[i*size:end]...)
+		footer := fmt.Sprintf("Page %d/%d", i+1, count)
+		if i < count-1 {
+			footer += ", " + bot.Prefix + "schedule more for the next page"
+		}
+		pages = append(pages, append(page, footer))
+	}
+	return pages
+}
+
+// private is the message as if it were sent to the bot privately,
+// the replies go to the sender
+func (bot *Settings) private(m *kitty.Message) *kitty.Message {
+	msg := *m.Message
+	msg.Tags = nil
+	return &kitty.Message{
+		Message:   &msg,
+		Content:   m.Content,
+		Raw:       m.Raw,
+		TimeStamp: m.TimeStamp,
+		To:        bot.irc.Prefix().Name,
+		From:      m.From,
+	}
+}
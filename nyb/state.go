@@ -0,0 +1,148 @@
+package nyb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// state is what the bot remembers between restarts
+type state struct {
+	// The year the state is about
+	Target int `json:"target"`
+	// Offset of the last zone announced per channel
+	Announced map[string]float64 `json:"announced"`
+	// The first zone and the help were shown
+	Help bool `json:"help"`
+	sync.Mutex
+}
+
+// loadState reads the state file, a missing file or a state
+// about a past year gives an empty state for the target.
+// A state about the next year means the bot has already wrapped the year
+func (bot *Settings) loadState() (restarted bool) {
+	st := &bot.state
+	st.Lock()
+	defer st.Unlock()
+	st.Target = bot.target.Year()
+	st.Announced = make(map[string]float64)
+	st.Help = false
+	if bot.State == "" {
+		return false
+	}
+	data, err := os.ReadFile(bot.State)
+	if errors.Is(err, os.ErrNotExist) {
+		return false
+	}
+	if err != nil {
+		bot.schedLog.Error("state file", "error", err)
+		return false
+	}
+	var saved state
+	if err := json.Unmarshal(data, &saved); err != nil {
+		bot.schedLog.Error("state file", "error", fmt.Errorf("%s: %v", bot.State, err))
+		return false
+	}
+	if saved.Target < st.Target {
+		return false
+	}
+	if saved.Target > st.Target {
+		bot.target = bot.target.AddDate(saved.Target-st.Target, 0, 0)
+		st.Target = saved.Target
+	}
+	for ch, offset := range saved.Announced {
+		st.Announced[ch] = offset
+	}
+	st.Help = saved.Help
+	return true
+}
+
+// saveState writes the state file, replacing it atomically
+func (bot *Settings) saveState(update func(st *state)) {
+	st := &bot.state
+	st.Lock()
+	defer st.Unlock()
+	update(st)
+	if bot.State == "" {
+		return
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		bot.schedLog.Error("state file", "error", err)
+		return
+	}
+	if err := writeAtomic(bot.State, data); err != nil {
+		bot.schedLog.Error("state file", "error", err)
+	}
+}
+
+// writeAtomic replaces the file with the data through a temporary file
+func writeAtomic(file string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(append(data, '\n'))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// announced reports whether the zone was already announced in the channel
+func (bot *Settings) announced(ch string, offset float64) bool {
+	st := &bot.state
+	st.Lock()
+	defer st.Unlock()
+	last, ok := st.Announced[channelKey(ch)]
+	// Zones are announced from the highest offset down
+	return ok && offset >= last
+}
+
+// setAnnounced remembers the zone as the last one announced in the channel
+func (bot *Settings) setAnnounced(ch string, offset float64) {
+	bot.saveState(func(st *state) {
+		if st.Announced == nil {
+			st.Announced = make(map[string]float64)
+		}
+		st.Announced[channelKey(ch)] = offset
+	})
+}
+
+// awaySummary tells the channels about the zones that passed
+// while the bot was away, once after a restart
+func (bot *Settings) awaySummary(passed TZS) {
+	if len(passed) == 0 {
+		return
+	}
+	away := bot.col("Since I was away") + ", New Year arrived in "
+	for _, ch := range bot.irc.Channels {
+		var missed TZS
+		for _, zone := range passed {
+			if !bot.announced(ch, zone.Offset) {
+				missed = append(missed, zone)
+			}
+		}
+		if len(missed) == 0 {
+			continue
+		}
+		last := missed[len(missed)-1]
+		text := away
+		if len(missed) > 1 {
+			text += fmt.Sprintf("%d time zones, most recently in ", len(missed))
+		}
+		max := bot.irc.MsgMaxSize(channelName(ch)) - len(text)
+		bot.msg(ch, text+last.Format(max, bot.Colors))
+		bot.schedLog.Info("posted the away summary", "channel", ch, "zones", len(missed))
+		bot.setAnnounced(ch, last.Offset)
+	}
+}
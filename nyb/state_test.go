@@ -0,0 +1,75 @@
+package nyb_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ugjka/newyearsbot/nyb"
+)
+
+type savedState struct {
+	Target    int                `json:"target"`
+	Announced map[string]float64 `json:"announced"`
+	Help      bool               `json:"help"`
+}
+
+// waitState polls the state file until it satisfies match
+func waitState(t *testing.T, file string, match func(savedState) bool) savedState {
+	t.Helper()
+	var st savedState
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond * 50)
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		st = savedState{}
+		if err := json.Unmarshal(data, &st); err != nil {
+			t.Fatal(err)
+		}
+		if match(st) {
+			return st
+		}
+	}
+	t.Fatalf("unexpected state: %+v", st)
+	return st
+}
+
+// After the first two zones
+var restart = time.Date(2024, time.December, 31, 10, 20, 0, 0, time.UTC)
+
+const samoa = "Kiribati (Kanton, Phoenix Islands), New Zealand (Auckland, Wellington), " +
+	"Samoa (Apia), Tokelau (Atafu, Fakaofo), Tonga (Nuku'alofa)"
+
+func TestE2EFirstStart(t *testing.T) {
+	t.Parallel()
+	file := filepath.Join(t.TempDir(), "state.json")
+	e := startBot(t, newServer(t), "e2efirst", restart, func(s *nyb.Settings) {
+		s.State = file
+	})
+	e.expect("#test", "Next New Year in 39 minutes 53 seconds in "+samoa)
+	e.expect("#test", helpText)
+	waitState(t, file, func(st savedState) bool { return st.Target == 2025 && st.Help })
+}
+
+func TestE2ERestart(t *testing.T) {
+	t.Parallel()
+	file := filepath.Join(t.TempDir(), "state.json")
+	data, _ := json.Marshal(savedState{Target: 2025, Announced: map[string]float64{"#test": 14}, Help: true})
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	e := startBot(t, newServer(t), "e2erestart", restart, func(s *nyb.Settings) {
+		s.State = file
+	})
+	e.expect("#test", "Since I was away, New Year arrived in New Zealand (Chatham Islands)")
+	// No help blurb again
+	e.expect("#test", "Next New Year in 39 minutes 53 seconds. See !next or !help.")
+
+	e.clock.Advance(time.Minute * 40)
+	e.expect("#test", "Happy New Year in "+samoa)
+	waitState(t, file, func(st savedState) bool { return st.Announced["#test"] == 13 })
+}
@@ -0,0 +1,323 @@
+package nyb
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	kitty "github.com/ugjka/kittybot"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// errStopped is returned by dial after Stop
+var errStopped = errors.New("bot stopped")
+
+// Stop disconnects the bot and stops the scheduler,
+// a stopped bot can't be started again
+func (bot *Settings) Stop() {
+	bot.stopOnce.Do(func() {
+		bot.schedLog.Info("stopping the bot")
+		close(bot.quit)
+		bot.connMu.Lock()
+		defer bot.connMu.Unlock()
+		if bot.conn != nil {
+			// kittybot's queue might be full
+			bot.conn.SetWriteDeadline(time.Now().Add(time.Second))
+			fmt.Fprint(bot.conn, "QUIT :Stopped\r\n")
+			bot.conn.Close()
+		}
+	})
+}
+
+func (bot *Settings) stopped() bool {
+	select {
+	case <-bot.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// safeTrigger recovers the trigger's panics,
+// kittybot runs every trigger in its own goroutine
+type safeTrigger struct {
+	kitty.Trigger
+	bot *Settings
+}
+
+func (t safeTrigger) Handle(b *kitty.Bot, m *kitty.Message) {
+	defer t.bot.recoverPanic("trigger")
+	t.Trigger.Handle(b, m)
+}
+
+func (bot *Settings) addTrigger(t kitty.Trigger) {
+	bot.irc.AddTrigger(safeTrigger{Trigger: t, bot: bot})
+}
+
+// recoverPanic logs and counts a panic, it must be deferred
+func (bot *Settings) recoverPanic(where string) {
+	if r := recover(); r != nil {
+		bot.panicked(where, r)
+	}
+}
+
+func (bot *Settings) panicked(where string, r interface{}) {
+	atomic.AddInt32(&bot.panics, 1)
+	bot.lastPanic.Store(fmt.Sprint(r))
+	panicsCounter.Inc(bot.server(), bot.Nick)
+	bot.schedLog.Crit("panic", "in", where, "panic", r, "stack", string(debug.Stack()))
+}
+
+// Health is the health of a supervised bot
+type Health struct {
+	Name      string
+	Server    string
+	Nick      string
+	Running   bool
+	Connected bool
+	// Restarts after a panic or an unexpected stop
+	Restarts  int
+	Panics    int
+	LastPanic string
+	// When the bot was last started
+	Started time.Time
+}
+
+// Bot is a bot for the supervisor
+type Bot struct {
+	Name string
+	// Config identifies the configuration, a reload restarts the bot when it changes
+	Config string
+	// New creates the bot, it's called on every start
+	New func() (*Settings, error)
+}
+
+// Supervisor runs the bots, restarting them after a panic
+type Supervisor struct {
+	// Load returns the bots, it's called by Run and on reload
+	Load   func() ([]Bot, error)
+	Logger log.Logger
+	// Delay before restarting a bot that stopped on its own, defaults to 10 seconds
+	RestartDelay time.Duration
+	bots         map[string]*supervised
+	sync.Mutex
+}
+
+type supervised struct {
+	Bot
+	bot      *Settings
+	running  bool
+	restarts int
+	// Panics of the previous instances
+	panics    int
+	lastPanic string
+	started   time.Time
+}
+
+// Run loads and starts the bots
+func (s *Supervisor) Run() error {
+	if s.Logger == nil {
+		s.Logger = log.New("subsys", "supervisor")
+	}
+	if s.RestartDelay == 0 {
+		s.RestartDelay = time.Second * 10
+	}
+	bots, err := s.Load()
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.bots = make(map[string]*supervised)
+	for _, b := range bots {
+		sb := &supervised{Bot: b}
+		s.bots[b.Name] = sb
+		if err := s.start(sb); err != nil {
+			return fmt.Errorf("%s: %v", b.Name, err)
+		}
+	}
+	return nil
+}
+
+// start is called with the lock held
+func (s *Supervisor) start(sb *supervised) error {
+	bot, err := sb.New()
+	if err != nil {
+		return err
+	}
+	if sb.bot != nil {
+		sb.panics += int(atomic.LoadInt32(&sb.bot.panics))
+		if p, ok := sb.bot.lastPanic.Load().(string); ok {
+			sb.lastPanic = p
+		}
+	}
+	sb.bot = bot
+	sb.running = true
+	sb.started = time.Now()
+	botsRunning.Set(1, sb.Name)
+	s.Logger.Info("starting", "name", sb.Name)
+	go s.run(sb, bot)
+	return nil
+}
+
+// run runs the bot and restarts it if it stops on its own
+func (s *Supervisor) run(sb *supervised, bot *Settings) {
+	defer func() {
+		if r := recover(); r != nil {
+			bot.panicked("scheduler", r)
+		}
+		bot.Stop()
+		s.Lock()
+		defer s.Unlock()
+		if sb.bot != bot || !sb.running {
+			return
+		}
+		sb.restarts++
+		s.Logger.Error("bot stopped unexpectedly, restarting", "name", sb.Name, "in", s.RestartDelay)
+		time.AfterFunc(s.RestartDelay, func() {
+			s.Lock()
+			defer s.Unlock()
+			// Stopped or replaced in the meantime
+			if sb.bot != bot || !sb.running {
+				return
+			}
+			if err := s.start(sb); err != nil {
+				sb.running = false
+				botsRunning.Set(0, sb.Name)
+				s.Logger.Error("restart failed", "name", sb.Name, "error", err)
+			}
+		})
+	}()
+	bot.Start()
+}
+
+// stop is called with the lock held
+func (s *Supervisor) stop(sb *supervised) {
+	sb.running = false
+	botsRunning.Set(0, sb.Name)
+	s.Logger.Info("stopping", "name", sb.Name)
+	sb.bot.Stop()
+}
+
+// Start starts a stopped bot
+func (s *Supervisor) Start(name string) error {
+	s.Lock()
+	defer s.Unlock()
+	sb, ok := s.bots[name]
+	if !ok {
+		return fmt.Errorf("no such bot: %s", name)
+	}
+	if sb.running {
+		return fmt.Errorf("already running: %s", name)
+	}
+	return s.start(sb)
+}
+
+// Stop stops a bot
+func (s *Supervisor) Stop(name string) error {
+	s.Lock()
+	defer s.Unlock()
+	sb, ok := s.bots[name]
+	if !ok {
+		return fmt.Errorf("no such bot: %s", name)
+	}
+	if !sb.running {
+		return fmt.Errorf("not running: %s", name)
+	}
+	s.stop(sb)
+	return nil
+}
+
+// StopAll stops all the bots
+func (s *Supervisor) StopAll() {
+	s.Lock()
+	defer s.Unlock()
+	for _, sb := range s.bots {
+		if sb.running {
+			s.stop(sb)
+		}
+	}
+}
+
+// Reload loads the bots again, starts the new ones, stops the removed ones
+// and restarts the ones whose configuration changed
+func (s *Supervisor) Reload() error {
+	bots, err := s.Load()
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	loaded := make(map[string]bool)
+	var errs []string
+	for _, b := range bots {
+		loaded[b.Name] = true
+		sb, ok := s.bots[b.Name]
+		if ok && sb.Config == b.Config {
+			continue
+		}
+		if !ok {
+			sb = &supervised{}
+			s.bots[b.Name] = sb
+		}
+		sb.Bot = b
+		// Bots stopped over the control socket stay stopped
+		if ok && !sb.running {
+			continue
+		}
+		if ok {
+			s.stop(sb)
+		}
+		if err := s.start(sb); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", b.Name, err))
+		}
+	}
+	for name, sb := range s.bots {
+		if loaded[name] {
+			continue
+		}
+		if sb.running {
+			s.stop(sb)
+		}
+		delete(s.bots, name)
+		s.Logger.Info("removed", "name", name)
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// List returns the health of the bots sorted by name
+func (s *Supervisor) List() []Health {
+	s.Lock()
+	defer s.Unlock()
+	var list []Health
+	for _, sb := range s.bots {
+		h := Health{
+			Name:      sb.Name,
+			Running:   sb.running,
+			Restarts:  sb.restarts,
+			Panics:    sb.panics,
+			LastPanic: sb.lastPanic,
+			Started:   sb.started,
+		}
+		if bot := sb.bot; bot != nil {
+			h.Server = bot.server()
+			h.Nick = bot.Nick
+			h.Connected = sb.running && bot.isConnected()
+			h.Panics += int(atomic.LoadInt32(&bot.panics))
+			if p, ok := bot.lastPanic.Load().(string); ok {
+				h.LastPanic = p
+			}
+		}
+		list = append(list, h)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
@@ -0,0 +1,160 @@
+package nyb_test
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ugjka/newyearsbot/nyb"
+	"github.com/ugjka/newyearsbot/nyb/clock"
+	"github.com/ugjka/newyearsbot/nyb/clock/clocktest"
+	"github.com/ugjka/newyearsbot/nyb/irctest"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// panicClock panics when the scheduler starts waiting for a zone
+type panicClock struct {
+	*clocktest.Fake
+}
+
+func (panicClock) NewTimer(time.Duration) *clock.Timer {
+	panic("boom")
+}
+
+// control sends a command to the control socket and returns the reply lines
+func control(t *testing.T, r *bufio.Reader, conn net.Conn, cmd string) []string {
+	t.Helper()
+	if _, err := conn.Write([]byte(cmd + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+		line = strings.TrimSpace(line)
+		lines = append(lines, line)
+		if line == "ok" || strings.HasPrefix(line, "error: ") {
+			return lines
+		}
+	}
+}
+
+func TestSupervisor(t *testing.T) {
+	t.Parallel()
+	srv := newServer(t)
+	var starts int32
+	bot := nyb.Bot{
+		Name:   "party",
+		Config: "v1",
+		New: func() (*nyb.Settings, error) {
+			var clk clock.Clock = clocktest.New(eve)
+			// The first run panics
+			if atomic.AddInt32(&starts, 1) == 1 {
+				clk = panicClock{clocktest.New(eve)}
+			}
+			bot := nyb.New(&nyb.Settings{
+				Nick:      "e2esup",
+				Channels:  []string{"#test"},
+				Server:    srv.Addr(),
+				Prefix:    "!",
+				Email:     "test@example.com",
+				Nominatim: "http://127.0.0.1:1",
+				Clock:     clk,
+			})
+			bot.LogLvl(log.LvlCrit)
+			return bot, nil
+		},
+	}
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	sup := &nyb.Supervisor{
+		Load:         func() ([]nyb.Bot, error) { return []nyb.Bot{bot}, nil },
+		Logger:       logger,
+		RestartDelay: time.Millisecond * 100,
+	}
+	if err := sup.Run(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sup.StopAll)
+
+	// Restarted after the panic
+	if _, err := srv.Expect(timeout, func(l irctest.Line) bool { return l.Command == "QUIT" }); err != nil {
+		t.Fatal("the panicked bot didn't quit:", err)
+	}
+	e := &e2e{t: t, srv: srv, nick: "e2esup"}
+	e.expect("#test", "First New Year in 53 seconds in "+kiribati)
+	list := sup.List()
+	if len(list) != 1 || list[0].Name != "party" || !list[0].Running || list[0].Restarts != 1 ||
+		list[0].Panics != 1 || list[0].LastPanic != "boom" {
+		t.Fatalf("unexpected health: %+v", list)
+	}
+
+	dir, err := os.MkdirTemp("", "nyb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "control.sock")
+	ln, err := sup.Control(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	if _, err := sup.Control(path); err == nil {
+		t.Error("expected the socket to be in use")
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	lines := control(t, r, conn, "list")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "party running connected server="+srv.Addr()+
+		" nick=e2esup restarts=1 panics=1 uptime=") || !strings.HasSuffix(lines[0], `last-panic="boom"`) {
+		t.Errorf("unexpected list: %q", lines)
+	}
+	if lines := control(t, r, conn, "stop party"); lines[0] != "ok" {
+		t.Errorf("stop: %q", lines)
+	}
+	if _, err := srv.Expect(timeout, func(l irctest.Line) bool { return l.Command == "QUIT" }); err != nil {
+		t.Fatal("the stopped bot didn't quit:", err)
+	}
+	if lines := control(t, r, conn, "list"); !strings.HasPrefix(lines[0], "party stopped disconnected ") {
+		t.Errorf("unexpected list: %q", lines)
+	}
+	for _, tc := range []struct{ cmd, reply string }{
+		{"stop party", "error: not running: party"},
+		{"start nope", "error: no such bot: nope"},
+		{"frobnicate", "error: unknown command: frobnicate"},
+		{"start party", "ok"},
+	} {
+		if lines := control(t, r, conn, tc.cmd); lines[len(lines)-1] != tc.reply {
+			t.Errorf("%s: expected %q; got %q", tc.cmd, tc.reply, lines)
+		}
+	}
+	if err := srv.WaitJoin(timeout, "e2esup", "#test"); err != nil {
+		t.Fatal("the started bot didn't join:", err)
+	}
+
+	// A changed configuration restarts the bot
+	bot.Config = "v2"
+	if lines := control(t, r, conn, "reload"); lines[0] != "ok" {
+		t.Errorf("reload: %q", lines)
+	}
+	if _, err := srv.Expect(timeout, func(l irctest.Line) bool { return l.Command == "QUIT" }); err != nil {
+		t.Fatal("the reloaded bot didn't quit:", err)
+	}
+	if n := atomic.LoadInt32(&starts); n != 4 {
+		t.Errorf("expected 4 starts; got %d", n)
+	}
+}
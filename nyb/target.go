@@ -1,21 +1,27 @@
 package nyb
 
-import "time"
+import (
+	"time"
+
+	"github.com/ugjka/newyearsbot/nyb/clock"
+)
 
 // Set the target year
-var target = func() time.Time {
-	tmp := now().UTC()
+func newTarget(t time.Time) time.Time {
+	tmp := t.UTC()
 	if tmp.Month() == time.January && tmp.Day() < 2 {
 		return time.Date(tmp.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
 	}
-	//Debug target
-	//return time.Date(tmp.Year(), time.January, 20, 1, 0, 0, 0, time.UTC)
 	return time.Date(tmp.Year()+1, time.January, 1, 0, 0, 0, 0, time.UTC)
-}()
+}
 
-// Set now
-var now = func() time.Time {
-	return time.Now()
-	// debug fake time
-	//return time.Date(2024, 1, 1, 0, 0, 1, 100000011, time.Now().Location())
+// Simulation returns a virtual clock that starts at start
+// and runs speed times faster than the real time.
+// A zero start is a minute before the first zone's new year
+func Simulation(start time.Time, speed float64) *clock.Simulated {
+	if start.IsZero() {
+		// UTC+14 is the first zone
+		start = newTarget(time.Now()).Add(-14*time.Hour - time.Minute)
+	}
+	return clock.NewSimulated(start, speed)
 }
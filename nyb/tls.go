@@ -0,0 +1,153 @@
+package nyb
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TLS configures the certificate verification of the irc connection
+type TLS struct {
+	// PEM bundle of the CA certificates to trust instead of the system ones
+	CA string
+	// Verify the certificate against this name instead of the server's host
+	ServerName string
+	// Minimum TLS version: 1.0, 1.1, 1.2 or 1.3 (default: 1.2)
+	MinVersion string
+	// Accept only certificates with these SHA-256 fingerprints (hex, colons optional),
+	// pinned certificates don't need to be signed by a trusted CA
+	Fingerprints []string
+	// Skip the certificate verification entirely
+	Insecure bool
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Check validates the TLS configuration
+func (t TLS) Check() error {
+	if t.MinVersion != "" {
+		if _, ok := tlsVersions[t.MinVersion]; !ok {
+			return fmt.Errorf("invalid minimum tls version: %s", t.MinVersion)
+		}
+	}
+	for _, fp := range t.Fingerprints {
+		if _, err := parseFingerprint(fp); err != nil {
+			return err
+		}
+	}
+	if t.CA != "" {
+		if _, err := t.pool(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t TLS) pool() (*x509.CertPool, error) {
+	data, err := os.ReadFile(t.CA)
+	if err != nil {
+		return nil, fmt.Errorf("tls ca: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("tls ca: no certificates found in %s", t.CA)
+	}
+	return pool, nil
+}
+
+func parseFingerprint(fp string) ([]byte, error) {
+	raw, err := hex.DecodeString(strings.ReplaceAll(fp, ":", ""))
+	if err != nil || len(raw) != sha256.Size {
+		return nil, fmt.Errorf("invalid sha-256 fingerprint: %s", fp)
+	}
+	return raw, nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the certificate
+// in the format accepted by TLS.Fingerprints
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	var x []string
+	for _, b := range sum {
+		x = append(x, fmt.Sprintf("%02X", b))
+	}
+	return strings.Join(x, ":")
+}
+
+// apply applies the TLS settings to config
+func (t TLS) apply(config *tls.Config) error {
+	if t.ServerName != "" {
+		config.ServerName = t.ServerName
+	}
+	config.MinVersion = tls.VersionTLS12
+	if t.MinVersion != "" {
+		config.MinVersion = tlsVersions[t.MinVersion]
+	}
+	if t.CA != "" {
+		pool, err := t.pool()
+		if err != nil {
+			return err
+		}
+		config.RootCAs = pool
+	}
+	if t.Insecure {
+		config.InsecureSkipVerify = true
+	}
+	if len(t.Fingerprints) > 0 {
+		var pins [][]byte
+		for _, fp := range t.Fingerprints {
+			pin, err := parseFingerprint(fp)
+			if err != nil {
+				return err
+			}
+			pins = append(pins, pin)
+		}
+		// The pin replaces the chain verification
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("tls: server sent no certificate")
+			}
+			sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+			for _, pin := range pins {
+				if string(pin) == string(sum[:]) {
+					return nil
+				}
+			}
+			return fmt.Errorf("tls: server certificate fingerprint %s doesn't match the pinned fingerprints",
+				Fingerprint(cs.PeerCertificates[0]))
+		}
+	}
+	return nil
+}
+
+// tlsError explains certificate verification failures
+func tlsError(err error, host string) error {
+	var unknown x509.UnknownAuthorityError
+	if errors.As(err, &unknown) && unknown.Cert != nil {
+		return fmt.Errorf("tls: certificate of %s is signed by an unknown authority (%s), "+
+			"set tls ca to the CA bundle or pin the certificate fingerprint %s",
+			host, unknown.Cert.Issuer, Fingerprint(unknown.Cert))
+	}
+	var hostname x509.HostnameError
+	if errors.As(err, &hostname) && hostname.Certificate != nil {
+		return fmt.Errorf("tls: certificate is not valid for %s (valid for %s), "+
+			"set tls servername if the server is known by another name",
+			hostname.Host, strings.Join(hostname.Certificate.DNSNames, ", "))
+	}
+	var invalid x509.CertificateInvalidError
+	if errors.As(err, &invalid) && invalid.Cert != nil {
+		return fmt.Errorf("tls: certificate of %s is invalid: %v", host, invalid)
+	}
+	return err
+}
@@ -0,0 +1,154 @@
+package nyb
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ugjka/newyearsbot/nyb/irctest"
+)
+
+// testCA returns a CA bundle file and a server certificate for irc.test signed by it
+func testCA(t *testing.T) (string, tls.Certificate) {
+	t.Helper()
+	key := func() *ecdsa.PrivateKey {
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	caKey := key()
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvKey := key()
+	srv := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "irc.test"},
+		DNSNames:     []string{"irc.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	srvDER, err := x509.CreateCertificate(rand.Reader, srv, ca, &srvKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	err = os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file, tls.Certificate{Certificate: [][]byte{srvDER}, PrivateKey: srvKey}
+}
+
+func TestTLSDial(t *testing.T) {
+	ca, cert := testCA(t)
+	srv, err := irctest.NewTLSServer(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MaxVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pin := Fingerprint(leaf)
+
+	tt := []struct {
+		name string
+		tls  TLS
+		err  string
+	}{
+		{"ca", TLS{CA: ca, ServerName: "irc.test"}, ""},
+		{"unknown ca", TLS{ServerName: "irc.test"}, "unknown authority (CN=Test CA), set tls ca to the CA bundle or pin the certificate fingerprint " + pin},
+		{"hostname", TLS{CA: ca}, "not valid for 127.0.0.1 (valid for irc.test)"},
+		{"pin", TLS{Fingerprints: []string{pin}}, ""},
+		{"pin lowercase", TLS{Fingerprints: []string{strings.ToLower(strings.ReplaceAll(pin, ":", ""))}}, ""},
+		{"pin mismatch", TLS{Fingerprints: []string{strings.Repeat("00", 32)}}, "fingerprint " + pin + " doesn't match"},
+		{"insecure", TLS{Insecure: true}, ""},
+		{"min version", TLS{CA: ca, ServerName: "irc.test", MinVersion: "1.3"}, "protocol version"},
+	}
+	for _, tc := range tt {
+		bot := &Settings{SSL: true, TLS: tc.tls}
+		conn, err := bot.dial("tcp", srv.Addr())
+		if err == nil {
+			conn.Close()
+		}
+		if tc.err == "" && err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+		if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%s: expected error %q; got %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+func TestCheckConnection(t *testing.T) {
+	_, cert := testCA(t)
+	srv, err := irctest.NewTLSServer(&tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	bot := &Settings{Server: srv.Addr(), SSL: true, TLS: TLS{Insecure: true}}
+	if err := bot.CheckConnection(); err != nil {
+		t.Error(err)
+	}
+	bot.TLS.Insecure = false
+	if err := bot.CheckConnection(); err == nil || !strings.Contains(err.Error(), "not valid for 127.0.0.1") {
+		t.Errorf("expected a hostname error; got %v", err)
+	}
+	srv.Close()
+	if err := bot.CheckConnection(); err == nil {
+		t.Error("expected a connection error")
+	}
+}
+
+func TestTLSCheck(t *testing.T) {
+	ca, _ := testCA(t)
+	tt := []struct {
+		tls TLS
+		err string
+	}{
+		{TLS{}, ""},
+		{TLS{CA: ca, MinVersion: "1.3", Fingerprints: []string{strings.Repeat("AB:", 31) + "AB"}}, ""},
+		{TLS{MinVersion: "1.4"}, "invalid minimum tls version"},
+		{TLS{Fingerprints: []string{"AB:CD"}}, "invalid sha-256 fingerprint"},
+		{TLS{CA: "missing.pem"}, "tls ca"},
+	}
+	for _, tc := range tt {
+		err := tc.tls.Check()
+		if tc.err == "" && err != nil {
+			t.Errorf("%+v: unexpected error: %v", tc.tls, err)
+		}
+		if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%+v: expected error %q; got %v", tc.tls, tc.err, err)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package nyb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	kitty "github.com/ugjka/kittybot"
+)
+
+// users are the saved locations of the users, by account or nick
+type users struct {
+	saved map[string]*user
+	sync.Mutex
+}
+
+// user is a user's saved location
+type user struct {
+	// The nick the user was last seen with
+	Nick  string `json:"nick"`
+	Place string `json:"place"`
+	// IANA zone name or UTC offset
+	Zone string `json:"zone"`
+	// Mention the user when the zone reaches midnight,
+	// in the channel's announcement or privately without a channel
+	Notify  bool   `json:"notify,omitempty"`
+	Channel string `json:"channel,omitempty"`
+}
+
+// loadUsers reads the users file, a missing file gives no users
+func (bot *Settings) loadUsers() {
+	u := &bot.users
+	u.Lock()
+	defer u.Unlock()
+	u.saved = make(map[string]*user)
+	if bot.Users == "" {
+		return
+	}
+	data, err := os.ReadFile(bot.Users)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		bot.irc.Error("users file", "error", err)
+		return
+	}
+	var saved map[string]*user
+	if err := json.Unmarshal(data, &saved); err != nil {
+		bot.irc.Error("users file", "error", fmt.Errorf("%s: %v", bot.Users, err))
+		return
+	}
+	for key, s := range saved {
+		if s != nil {
+			u.saved[key] = s
+		}
+	}
+}
+
+// saveUsers writes the users file atomically, the caller holds the lock
+func (bot *Settings) saveUsers() {
+	if bot.Users == "" {
+		return
+	}
+	data, err := json.Marshal(bot.users.saved)
+	if err != nil {
+		bot.irc.Error("users file", "error", err)
+		return
+	}
+	if err := writeAtomic(bot.Users, data); err != nil {
+		bot.irc.Error("users file", "error", err)
+	}
+}
+
+// userKey identifies the user by the services account when the server sends account tags,
+// by the nick otherwise
+func userKey(m *kitty.Message) string {
+	if account, ok := m.Tags.GetTag("account"); ok && account != "" && account != "*" {
+		return "account:" + strings.ToLower(account)
+	}
+	return strings.ToLower(m.Name)
+}
+
+// loadZone loads a saved zone, an IANA zone name or a UTC offset
+func loadZone(name string) (*time.Location, error) {
+	if p, ok, err := parseOffset(name); ok {
+		return p.zone, err
+	}
+	return time.LoadLocation(name)
+}
+
+// savedPlace returns the user's saved location and remembers the user's current nick
+func (bot *Settings) savedPlace(m *kitty.Message) (place, bool) {
+	u := &bot.users
+	u.Lock()
+	defer u.Unlock()
+	s := u.saved[userKey(m)]
+	if s == nil {
+		return place{}, false
+	}
+	zone, err := loadZone(s.Zone)
+	if err != nil {
+		bot.irc.Warn("saved zone", "user", m.From, "zone", s.Zone, "error", err)
+		return place{}, false
+	}
+	if s.Nick != m.Name {
+		s.Nick = m.Name
+		bot.saveUsers()
+	}
+	return place{name: s.Place, zone: zone}, true
+}
+
+// userPlace locates the command's argument or returns the user's saved location,
+// ok is false when there's neither
+func (bot *Settings) userPlace(m *kitty.Message) (p place, ok bool, err error) {
+	if location := args(m.Content); location != "" {
+		p, err = bot.locate(m.Name, location)
+		return p, true, err
+	}
+	p, ok = bot.savedPlace(m)
+	return p, ok, nil
+}
+
+// setLocation saves the user's location for the commands without one
+func (bot *Settings) setLocation(m *kitty.Message, location string) {
+	p, err := bot.locate(m.Name, location)
+	if a, ok := err.(ambiguous); ok {
+		a.command = "setlocation"
+		err = a
+	}
+	if err != nil {
+		bot.queryError(m, err)
+		return
+	}
+	u := &bot.users
+	u.Lock()
+	if u.saved == nil {
+		u.saved = make(map[string]*user)
+	}
+	key := userKey(m)
+	s := u.saved[key]
+	if s == nil {
+		s = &user{}
+		u.saved[key] = s
+	}
+	s.Nick, s.Place, s.Zone = m.Name, p.name, p.zone.String()
+	bot.saveUsers()
+	u.Unlock()
+	name := p.name
+	if !strings.Contains(name, p.zone.String()) {
+		name += " (" + p.zone.String() + ")"
+	}
+	bot.reply(m, fmt.Sprintf("Saved your location: %s. '%[2]shny', '%[2]stime' and '%[2]scountdown' use it now, "+
+		"'%[2]snotifyme' mentions you at its midnight, '%[2]sforgetme' forgets it", name, bot.Prefix))
+}
+
+// forgetMe forgets the user's location
+func (bot *Settings) forgetMe(m *kitty.Message) {
+	u := &bot.users
+	u.Lock()
+	key := userKey(m)
+	_, ok := u.saved[key]
+	if ok {
+		delete(u.saved, key)
+		bot.saveUsers()
+	}
+	u.Unlock()
+	if !ok {
+		bot.reply(m, "I don't know your location")
+		return
+	}
+	bot.reply(m, "Forgot your location")
+}
+
+// countdown counts down to the New Year at the place
+func (bot *Settings) countdown(p place) string {
+	offset := zoneOffset(bot.target, p.zone)
+	left := bot.target.Sub(bot.now().UTC().Add(offset))
+	if left <= 0 {
+		return fmt.Sprintf("New Year in %s happened %s ago", p.name, humanDur(-left))
+	}
+	left = left.Truncate(time.Second)
+	h, mins, sec := int(left.Hours()), int(left.Minutes())%60, int(left.Seconds())%60
+	return fmt.Sprintf("%02d:%02d:%02d until New Year in %s", h, mins, sec, p.name)
+}
@@ -0,0 +1,134 @@
+package nyb_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ugjka/newyearsbot/nyb"
+)
+
+func TestE2EUsers(t *testing.T) {
+	t.Parallel()
+	file := filepath.Join(t.TempDir(), "users.json")
+	users := func(s *nyb.Settings) {
+		s.Users = file
+	}
+	srv := newServer(t)
+	srv.Caps = []string{"account-tag"}
+	srv.Logins = map[string]string{"user": "partyacct", "user_": "partyacct"}
+	e := startBot(t, srv, "e2eusers", eve, users)
+	e.expect("#test", "First New Year in 53 seconds in "+kiribati)
+	e.expect("#test", helpText)
+
+	e.command("!hny", helpText)
+	e.command("!countdown", "Usage: !countdown <location>, or save your location with !setlocation <place>")
+	e.command("!setlocation", "Usage: !setlocation <place>, e.g. !setlocation Riga")
+	e.command("!setlocation paris", "Which one? 1) Paris, France (Europe/Paris) 2) Paris, United States (America/Chicago). "+
+		"Pick with !setlocation <number>")
+	e.command("!setlocation 1", "Saved your location: Paris, Ile-de-France, Metropolitan France, France (Europe/Paris). "+
+		"'!hny', '!time' and '!countdown' use it now, '!notifyme' mentions you at its midnight, '!forgetme' forgets it")
+	e.command("!setlocation riga", "Saved your location: Riga, Latvia (Europe/Riga). "+
+		"'!hny', '!time' and '!countdown' use it now, '!notifyme' mentions you at its midnight, '!forgetme' forgets it")
+	e.command("!hny", "New Year in Riga, Latvia will happen in 12 hours 53 seconds")
+	e.command("!time", "Time in Riga, Latvia is Tue Dec 31 11:59:07 +0200 EET 2024")
+	e.command("!countdown", "12:00:53 until New Year in Riga, Latvia")
+	e.command("!countdown UTC+14", "00:00:53 until New Year in UTC+14")
+	// The location follows the account
+	e.srv.Privmsg("user_", "#test", "!hny")
+	e.expect("#test", "New Year in Riga, Latvia will happen in 12 hours 53 seconds")
+	e.srv.Privmsg("other", "#test", "!time")
+	e.expect("#test", "Time is Tue Dec 31 09:59:07 +0000 UTC 2024")
+
+	e.command("!forgetme", "Forgot your location")
+	e.command("!forgetme", "I don't know your location")
+	e.command("!notifyme", "Save your location first with !setlocation <place>")
+	e.command("!notifyme stop", "Usage: !notifyme [off]")
+	e.command("!setlocation +14", "Saved your location: UTC+14. "+
+		"'!hny', '!time' and '!countdown' use it now, '!notifyme' mentions you at its midnight, '!forgetme' forgets it")
+	e.srv.Privmsg("user", e.nick, "!notifyme")
+	e.expect("user", "I'll message you when New Year arrives in UTC+14, !notifyme off to stop")
+	e.command("!notifyme", "You'll be mentioned here when New Year arrives in UTC+14, !notifyme off to stop")
+	e.srv.Privmsg("other", "#test", "!setlocation Pacific/Kiritimati")
+	e.expect("#test", "Saved your location: Pacific/Kiritimati. "+
+		"'!hny', '!time' and '!countdown' use it now, '!notifyme' mentions you at its midnight, '!forgetme' forgets it")
+	e.srv.Privmsg("other", "#test", "!notifyme")
+	e.expect("#test", "You'll be mentioned here when New Year arrives in Pacific/Kiritimati, !notifyme off to stop")
+	e.srv.Privmsg("third", "#test", "!setlocation UTC+14")
+	e.expect("#test", "Saved your location: UTC+14. "+
+		"'!hny', '!time' and '!countdown' use it now, '!notifyme' mentions you at its midnight, '!forgetme' forgets it")
+	e.srv.Privmsg("third", e.nick, "!notifyme")
+	e.expect("third", "I'll message you when New Year arrives in UTC+14, !notifyme off to stop")
+	// The mention goes to the nick the user was last seen with
+	e.srv.Privmsg("user_", "#test", "!countdown")
+	e.expect("#test", "00:00:53 until New Year in UTC+14")
+
+	var saved map[string]struct {
+		Nick, Place, Zone, Channel string
+		Notify                     bool
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if got := saved["account:partyacct"]; got.Nick != "user_" || got.Zone != "UTC+14" || !got.Notify || got.Channel != "#test" {
+		t.Errorf("unexpected saved user: %+v", got)
+	}
+	if got := saved["other"]; got.Zone != "Pacific/Kiritimati" {
+		t.Errorf("unexpected saved user: %+v", got)
+	}
+
+	e.clock.Advance(time.Minute)
+	// Grouped into the announcement
+	e.expect("#test", "other, user_: Happy New Year in "+kiribati)
+	e.expect("third", "Happy New Year in UTC+14")
+	e.expect("#test", "Next New Year in 14 minutes 51 seconds. See !next or !help.")
+
+	// Remembered by a restarted bot
+	e = startBot(t, newServer(t), "e2eusers2", eve, users)
+	e.expect("#test", "First New Year in 53 seconds in "+kiribati)
+	e.expect("#test", helpText)
+	e.srv.Privmsg("other", "#test", "!time")
+	e.expect("#test", "Time in Pacific/Kiritimati is Tue Dec 31 23:59:07 +1400 +14 2024")
+}
+
+func TestE2ENotifyPrivately(t *testing.T) {
+	t.Parallel()
+	file := filepath.Join(t.TempDir(), "users.json")
+	saved := make(map[string]interface{})
+	for i := 0; i < 12; i++ {
+		nick := fmt.Sprintf("user%02d", i)
+		saved[nick] = map[string]interface{}{"nick": nick, "place": "UTC+14", "zone": "UTC+14", "notify": true}
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(t)
+	e := startBot(t, srv, "e2enotify", eve, func(s *nyb.Settings) {
+		s.Users = file
+		s.Limit = true
+	})
+	e.expect("#test", "First New Year in 53 seconds in "+kiribati)
+	e.expect("#test", helpText)
+
+	// The private messages are spaced out by the reply limiter, a burst would be flood kicked
+	srv.FloodLimit = 11
+	e.clock.Advance(time.Minute)
+	e.expect("#test", "Happy New Year in "+kiribati)
+	for i := 0; i < 12; i++ {
+		e.expect(fmt.Sprintf("user%02d", i), "Happy New Year in UTC+14")
+	}
+	if kicks := srv.Kicks(); len(kicks) > 0 {
+		t.Errorf("the bot was flood kicked: %v", kicks)
+	}
+}
@@ -26,3 +26,12 @@ func normalize(s string) string {
 	s = strings.Join(strings.Fields(s), " ")
 	return s
 }
+
+// args returns the command's arguments with their case, zone names are case sensitive
+func args(s string) string {
+	fields := strings.Fields(s)
+	if len(fields) < 2 {
+		return ""
+	}
+	return strings.Join(fields[1:], " ")
+}
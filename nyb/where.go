@@ -0,0 +1,100 @@
+package nyb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ugjka/newyearsbot/audit"
+)
+
+// zone describes the new year at a UTC offset like +9:30 or utc-3,
+// max is the reply's size
+func (bot *Settings) zone(arg string, max int) string {
+	offset, ok := offsetHours(arg)
+	if !ok {
+		return "Usage: " + bot.usage(bot.router.names["zone"])
+	}
+	name := audit.OffsetName(offset)
+	for _, zone := range bot.zones {
+		if zone.Offset != offset {
+			continue
+		}
+		until := bot.untilMidnight(offset)
+		if until > 0 {
+			msg := bot.col("New Year at "+name) + " will happen in " + bot.col(humanDur(until)) + " in "
+			return msg + zone.Format(max-len(msg), bot.Colors)
+		}
+		msg := bot.col("New Year at "+name) + " happened " + bot.col(humanDur(-until)) + " ago in "
+		return msg + zone.Format(max-len(msg), bot.Colors)
+	}
+	return "No one celebrates at " + name
+}
+
+// offsetHours parses a UTC offset in hours, the sign is optional
+func offsetHours(arg string) (float64, bool) {
+	p, ok, err := parseOffset(arg)
+	if !ok {
+		p, ok, err = parseOffset("+" + arg)
+	}
+	if !ok || err != nil {
+		return 0, false
+	}
+	_, seconds := time.Date(2000, time.January, 1, 0, 0, 0, 0, p.zone).Zone()
+	return float64(seconds) / 3600, true
+}
+
+// untilMidnight is the time until the new year at the offset, negative after it
+func (bot *Settings) untilMidnight(offset float64) time.Duration {
+	dur := time.Minute * time.Duration(offset*60)
+	return bot.target.Sub(bot.now().UTC().Add(dur))
+}
+
+// where lists the offsets of a country and whether they have celebrated
+func (bot *Settings) where(country string) string {
+	country = normalize(country)
+	var exact string
+	offsets := make(map[string][]float64)
+	for _, zone := range bot.zones {
+		for _, c := range zone.Countries {
+			name := normalize(c.Name)
+			if name == country {
+				exact = c.Name
+			}
+			if strings.Contains(name, country) {
+				offsets[c.Name] = append(offsets[c.Name], zone.Offset)
+			}
+		}
+	}
+	// An exact name beats the partial matches
+	if exact != "" {
+		offsets = map[string][]float64{exact: offsets[exact]}
+	}
+	var names []string
+	for name := range offsets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	switch {
+	case len(names) == 0:
+		return "couldn't find that country"
+	case len(names) > 5:
+		return "Which one? " + strings.Join(names[:5], ", ") + ", ..."
+	case len(names) > 1:
+		return "Which one? " + strings.Join(names, ", ")
+	}
+	name, list := names[0], offsets[names[0]]
+	// East to west, in the order of the celebrations
+	sort.Sort(sort.Reverse(sort.Float64Slice(list)))
+	var parts []string
+	for _, offset := range list {
+		until := bot.untilMidnight(offset)
+		if until > 0 {
+			parts = append(parts, fmt.Sprintf("%s in %s", audit.OffsetName(offset), humanDur(until)))
+		} else {
+			parts = append(parts, fmt.Sprintf("%s %s ago", audit.OffsetName(offset), humanDur(-until)))
+		}
+	}
+	return fmt.Sprintf("New Year in %s: %s", bot.col(name), strings.Join(parts, ", "))
+}
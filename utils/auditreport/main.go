@@ -0,0 +1,55 @@
+// This utility summarizes the announcement audit log, lateness and misses per channel
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ugjka/newyearsbot/audit"
+)
+
+func main() {
+	file := flag.String("file", "", "audit log file")
+	year := flag.Int("year", time.Now().Year(), "target year")
+	flag.Parse()
+	if *file == "" {
+		fmt.Fprintf(os.Stderr, "%s", "provide the audit log with -file flag\n")
+		return
+	}
+	f, err := os.Open(*file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	records, err := audit.Read(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+	summary := audit.Summarize(records, *year)
+	if len(summary) == 0 {
+		fmt.Println("No announcements for", *year)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVER\tCHANNEL\tSCHEDULED\tSENT\tDELIVERED\tERRORS\tMEAN LATE\tMAX LATE\tMISSED")
+	for _, s := range summary {
+		var missed []string
+		for _, offset := range s.Missed {
+			missed = append(missed, audit.OffsetName(offset))
+		}
+		maxLate := "-"
+		if s.Sent > 0 {
+			maxLate = fmt.Sprintf("%s (%s)", s.MaxLateness.Round(time.Millisecond),
+				audit.OffsetName(s.MaxLatenessOffset))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%s\t%s\t%s\n",
+			s.Server, s.Channel, s.Scheduled, s.Sent, s.Delivered, s.Errors,
+			s.MeanLateness.Round(time.Millisecond), maxLate, strings.Join(missed, ", "))
+	}
+	w.Flush()
+}
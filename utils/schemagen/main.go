@@ -0,0 +1,29 @@
+// This utility generates the JSON Schema of the config files for the editors,
+// run it with go generate ./config
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/ugjka/newyearsbot/config"
+)
+
+func main() {
+	out := flag.String("o", "settings.schema.json", "output file")
+	dirs := flag.String("src", ".,../nyb", "comma separated Go source directories of the config types")
+	flag.Parse()
+	docs, err := config.Docs(strings.Split(*dirs, ",")...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	schema, err := config.Schema(docs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*out, schema, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
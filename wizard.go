@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/ugjka/newyearsbot/config"
+	"github.com/ugjka/newyearsbot/nyb"
+)
+
+// wizard asks for the settings of a bot and writes them to a commented yaml config
+type wizard struct {
+	in  *bufio.Scanner
+	out io.Writer
+	bot config.Bot
+}
+
+// setup runs the init subcommand
+func setup(in io.Reader, out io.Writer, path string) error {
+	w := &wizard{in: bufio.NewScanner(in), out: out}
+	if _, err := os.Stat(path); err == nil {
+		overwrite, err := w.confirm(path+" exists, overwrite it?", false)
+		if err != nil || !overwrite {
+			return err
+		}
+	}
+	fmt.Fprintln(out, "Setting up a bot, press enter to accept the [default]")
+	b := &w.bot
+	steps := []struct {
+		fields []string
+		ask    func() error
+	}{
+		{[]string{"server"}, func() (err error) {
+			b.Server, err = w.ask("IRC server host:port", config.DefaultServer)
+			return err
+		}},
+		{[]string{"nossl"}, func() error {
+			ssl, err := w.confirm("Use SSL?", true)
+			b.NoSSL = !ssl
+			return err
+		}},
+		{[]string{"nick"}, func() (err error) {
+			b.Nick, err = w.ask("Nick", "")
+			return err
+		}},
+		{[]string{"channels"}, func() error {
+			list, err := w.ask("Channels, comma separated, a key follows a \":\" e.g. #party,#secret:key", "")
+			b.Channels = split(list)
+			return err
+		}},
+		{[]string{"email"}, func() (err error) {
+			b.Email, err = w.ask("Email for the nominatim geocoder usage policy", "")
+			return err
+		}},
+		{[]string{"colors"}, func() (err error) {
+			b.Colors, err = w.confirm("Decorate the messages with irc colors?", false)
+			return err
+		}},
+		// Client certificates need ssl
+		{[]string{"auth", "nossl"}, w.auth},
+	}
+	for _, step := range steps {
+		for {
+			if err := step.ask(); err != nil {
+				return err
+			}
+			err := validate(*b, step.fields...)
+			if err == nil {
+				break
+			}
+			fmt.Fprintln(out, err)
+		}
+	}
+	test, err := w.confirm("Test the connection to "+b.Server+"?", true)
+	if err != nil {
+		return err
+	}
+	if test {
+		// Like the bot that the config starts
+		c := config.Config{*b}
+		c.Defaults()
+		if err := settings(c[0]).CheckConnection(); err != nil {
+			fmt.Fprintln(out, "connection failed:", err)
+			write, err := w.confirm("Write the config anyway?", false)
+			if err != nil || !write {
+				return err
+			}
+		} else {
+			fmt.Fprintln(out, "connected")
+		}
+	}
+	if err := writeConfig(path, *b); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Wrote %s, start the bot with: newyearsbot -config %s\n", path, path)
+	return nil
+}
+
+func (w *wizard) auth() error {
+	// Forget the previous answers
+	w.bot.Auth = nyb.Auth{}
+	a := &w.bot.Auth
+	var err error
+	a.Mode, err = w.ask("Authentication: none, pass, sasl, external (SASL with client certificate) or nickserv", "none")
+	if err != nil {
+		return err
+	}
+	switch a.Mode {
+	case "none":
+		a.Mode = ""
+		return nil
+	case nyb.AuthSASL, nyb.AuthNickServ:
+		if a.User, err = w.ask("Account", w.bot.Nick); err != nil {
+			return err
+		}
+		if a.User == w.bot.Nick {
+			a.User = ""
+		}
+		fallthrough
+	case nyb.AuthPass:
+		a.Password, err = w.ask("Password", "")
+		return err
+	case nyb.AuthExternal:
+		if a.Cert, err = w.ask("Client certificate file", ""); err != nil {
+			return err
+		}
+		a.Key, err = w.ask("Client certificate key file", a.Cert)
+		if a.Key == a.Cert {
+			a.Key = ""
+		}
+		return err
+	}
+	return nil
+}
+
+// ask reads an answer, an empty answer is the default
+func (w *wizard) ask(question, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(w.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(w.out, "%s: ", question)
+	}
+	if !w.in.Scan() {
+		if err := w.in.Err(); err != nil {
+			return "", err
+		}
+		return "", io.ErrUnexpectedEOF
+	}
+	answer := strings.TrimSpace(w.in.Text())
+	if answer == "" {
+		return def, nil
+	}
+	return answer, nil
+}
+
+func (w *wizard) confirm(question string, def bool) (bool, error) {
+	hint := "y/N"
+	if def {
+		hint = "Y/n"
+	}
+	for {
+		answer, err := w.ask(question+" ["+hint+"]", "")
+		if err != nil {
+			return false, err
+		}
+		switch strings.ToLower(answer) {
+		case "":
+			return def, nil
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		}
+	}
+}
+
+func split(list string) []string {
+	var items []string
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			items = append(items, s)
+		}
+	}
+	return items
+}
+
+// validate checks the bot like the config file and returns the problems of the fields
+func validate(b config.Bot, fields ...string) error {
+	c := config.Config{b}
+	c.Defaults()
+	errs, ok := c.Check().(config.Errors)
+	if !ok {
+		return nil
+	}
+	var msgs []string
+	for _, e := range errs {
+		for _, field := range fields {
+			if e.Field == field || strings.HasPrefix(e.Field, field+"[") || strings.HasPrefix(e.Field, field+".") {
+				msgs = append(msgs, e.Msg)
+			}
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("error: %s", strings.Join(msgs, ", "))
+}
+
+var configTemplate = template.Must(template.New("settings.yaml").Funcs(template.FuncMap{
+	"quote": quote,
+	"list": func(items []string) string {
+		var quoted []string
+		for _, s := range items {
+			quoted = append(quoted, quote(s))
+		}
+		return "[" + strings.Join(quoted, ", ") + "]"
+	},
+}).Parse(`# written by newyearsbot init, start with: newyearsbot -config {{.Path}}
+# see settings.yaml in the repository for all the options
+- nick: {{quote .Bot.Nick}} # mandatory field
+  channels: {{list .Bot.Channels}} # channel with channel password after the ":"
+  server: {{quote .Bot.Server}}
+  nossl: {{.Bot.NoSSL}} # true to disable SSL for irc
+  email: {{quote .Bot.Email}} # mandatory field, for the nominatim usage policy
+  colors: {{.Bot.Colors}} # decorate irc messages
+{{- with .Bot.Auth}}{{if .Mode}}
+  auth:
+    mode: {{quote .Mode}} # pass, sasl, external or nickserv
+{{- if .User}}
+    user: {{quote .User}} # account name, defaults to the nick
+{{- end}}
+{{- if .Password}}
+    password: {{quote .Password}} # or password_file: /path/to/secret
+{{- end}}
+{{- if .Cert}}
+    cert: {{quote .Cert}} # client certificate for CertFP
+{{- end}}
+{{- if .Key}}
+    key: {{quote .Key}} # client certificate key, defaults to the cert file
+{{- end}}
+{{- end}}{{end}}
+  prefix: {{quote .Bot.Prefix}}
+  nominatim: {{quote .Bot.Nominatim}}
+`))
+
+// quote quotes a yaml string, ${ is escaped from the interpolation
+func quote(s string) string {
+	return strconv.Quote(strings.ReplaceAll(s, "${", "$${"))
+}
+
+// writeConfig writes the bot's commented config and loads it back
+func writeConfig(path string, b config.Bot) error {
+	c := config.Config{b}
+	c.Defaults()
+	var buf strings.Builder
+	err := configTemplate.Execute(&buf, struct {
+		Path string
+		Bot  config.Bot
+	}{path, c[0]})
+	if err != nil {
+		return err
+	}
+	// The file might hold a password, an overwritten file doesn't keep its mode
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".settings-*.yaml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(buf.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	_, err = config.Load(path)
+	return err
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ugjka/newyearsbot/config"
+)
+
+// load reads back the written config and checks it
+func load(t *testing.T, path string) config.Bot {
+	t.Helper()
+	c, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c) != 1 {
+		t.Fatalf("expected a bot; got %d", len(c))
+	}
+	return c[0]
+}
+
+func TestSetup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "settings.yaml")
+	script := strings.Join([]string{
+		"",                     // server
+		"",                     // ssl
+		"hnyparty",             // nick
+		"#party, #secret:key",  // channels
+		"test@example.com",     // email
+		"y",                    // colors
+		"sasl",                 // auth
+		"partyacct",            // account
+		`hunter2 #"[${NOPE}]:`, // password
+		"n",                    // connection test
+	}, "\n")
+	if err := setup(strings.NewReader(script), io.Discard, path); err != nil {
+		t.Fatal(err)
+	}
+	b := load(t, path)
+	if b.Server != config.DefaultServer || b.NoSSL || b.Nick != "hnyparty" || !b.Colors ||
+		!reflect.DeepEqual(b.Channels, []string{"#party", "#secret:key"}) || b.Email != "test@example.com" {
+		t.Errorf("unexpected config: %+v", b)
+	}
+	if b.Auth.Mode != "sasl" || b.Auth.User != "partyacct" || b.Auth.Password != `hunter2 #"[${NOPE}]:` {
+		t.Errorf("unexpected auth: %+v", b.Auth)
+	}
+
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected a private config; got %v, %v", info.Mode(), err)
+	}
+
+	// An overwritten config becomes private
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := setup(strings.NewReader("y\n"+script), io.Discard, path); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected a private config; got %v, %v", info.Mode(), err)
+	}
+
+	// An existing config is kept unless overwriting is confirmed
+	if err := setup(strings.NewReader("\n"), io.Discard, path); err != nil {
+		t.Fatal(err)
+	}
+	if b := load(t, path); b.Nick != "hnyparty" {
+		t.Errorf("the config was overwritten: %+v", b)
+	}
+}
+
+func TestSetupInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "settings.yaml")
+	script := strings.Join([]string{
+		"irc.example.com:6697",
+		"maybe", // not a yes or no
+		"n",
+		"hnypartyhnypartyhny", // too long
+		"hnyparty",
+		"party", // not a channel
+		"#party",
+		"not an email",
+		"test@example.com",
+		"",
+		"external", // needs ssl
+		"cert.pem",
+		"",
+		"none",
+		"n",
+	}, "\n")
+	var out strings.Builder
+	if err := setup(strings.NewReader(script), &out, path); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{
+		"Use SSL? [Y/n]: Use SSL? [Y/n]: ",
+		"error: nick too long",
+		"error: invalid channel name: party",
+		"error: invalid email address",
+		"error: client certificate: open cert.pem: no such file or directory, client certificates need ssl",
+	} {
+		if !strings.Contains(out.String(), msg) {
+			t.Errorf("expected %q in the output:\n%s", msg, out.String())
+		}
+	}
+	b := load(t, path)
+	if b.Server != "irc.example.com:6697" || !b.NoSSL || b.Nick != "hnyparty" || b.Auth.Mode != "" {
+		t.Errorf("unexpected config: %+v", b)
+	}
+
+	// Without answers
+	path = filepath.Join(t.TempDir(), "settings.yaml")
+	if err := setup(strings.NewReader(""), io.Discard, path); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected %v; got %v", io.ErrUnexpectedEOF, err)
+	}
+	if _, err := os.Stat(path); err == nil {
+		t.Error("expected no config")
+	}
+}